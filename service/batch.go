@@ -0,0 +1,107 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/jibenliu/utMsgDaemon/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// BatchResult 批量操作中单个key的结果，对应dbus结构(sbs)
+type BatchResult struct {
+	Key   string
+	OK    bool
+	Error string
+}
+
+// BatchJobResult 带任务ID的批量操作结果，对应dbus结构(sbss)
+type BatchJobResult struct {
+	Key   string
+	OK    bool
+	Error string
+	JobID string //提交为后台任务时的任务ID，OK表示任务已提交
+}
+
+// uploadMany 批量提交上传任务，UploadMany及UploadManyWithJobs使用相同的鉴权规则
+func uploadMany(sender dbus.Sender, keys []string) ([]BatchJobResult, *dbus.Error) {
+	caller, derr := authorizer.Authorize(string(sender), "UploadMany")
+	if derr != nil {
+		return nil, derr
+	}
+	return runBatch("UploadMany", keys, func(key string) (string, error) {
+		job, err := submitUpload(caller, key)
+		return job.ID, err
+	}), nil
+}
+
+// deleteMany 批量删除云端文件，离线时提交删除任务，DeleteMany及DeleteManyWithJobs使用相同的鉴权规则
+func deleteMany(sender dbus.Sender, keys []string) ([]BatchJobResult, *dbus.Error) {
+	caller, derr := authorizer.Authorize(string(sender), "DeleteMany")
+	if derr != nil {
+		return nil, derr
+	}
+	return runBatch("DeleteMany", keys, func(key string) (string, error) {
+		if err := checkKey(caller.UID, key); err != nil {
+			return "", err
+		}
+		if network.Online() {
+			_, err := deleteFile(key)
+			return "", err
+		}
+		return deferDelete(key, caller.UID)
+	}), nil
+}
+
+//
+// runBatch
+//  @Description: 按transfer.parallel限制并发执行批量操作，单个key失败不影响其他key
+//  @param method 方法名，用于日志
+//  @param keys
+//  @param fn 处理单个key
+//  @return []BatchJobResult 与keys顺序一致
+//
+func runBatch(method string, keys []string, fn func(key string) (string, error)) []BatchJobResult {
+	results := make([]BatchJobResult, len(keys))
+	sem := make(chan struct{}, utils.Conf().Transfer.Parallel)
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		results[i].Key = key
+		if len(key) == 0 {
+			results[i].Error = "param invalid"
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, key string) {
+			defer func() {
+				if r := recover(); r != nil {
+					results[i].OK = false
+					results[i].Error = "internal error"
+					log.Errorf("%s %s panic: %v", method, key, r)
+				}
+				<-sem
+				wg.Done()
+			}()
+			jobID, err := fn(key)
+			if err != nil {
+				log.Errorf("%s %s error:[%s]", method, key, err.Error())
+				results[i].Error = err.Error()
+				return
+			}
+			results[i].OK = true
+			results[i].JobID = jobID
+		}(i, key)
+	}
+	wg.Wait()
+	return results
+}
+
+// withoutJobIDs 去掉任务ID，用于返回(sbs)的方法
+func withoutJobIDs(results []BatchJobResult) []BatchResult {
+	list := make([]BatchResult, len(results))
+	for i, item := range results {
+		list[i] = BatchResult{Key: item.Key, OK: item.OK, Error: item.Error}
+	}
+	return list
+}
@@ -1,38 +1,42 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/introspect"
 	"github.com/jibenliu/utMsgDaemon/utils"
 	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
 )
 
 func initDbusService() {
-	conn, err := dbus.SessionBus()
-	if err != nil {
-		log.Fatalf("connect session bus fail: %v", err)
+	cfg := utils.Conf()
+	if err := tokens.init(cfg); err != nil {
+		log.Fatalf("init token store fail:%v", err)
 		return
 	}
-	reply, err := conn.RequestName(utils.ServiceName, dbus.NameFlagDoNotQueue)
-	if err != nil {
-		log.Fatalf("query service name state fail:%v", err)
-		return
-	} else if reply != dbus.RequestNameReplyPrimaryOwner {
-		log.Fatalln("service name already exists!")
+	if err := initJobs(cfg); err != nil {
+		log.Fatalf("init job queue fail:%v", err)
 		return
 	}
-	s := &Service{
-		ID:    "2",
-		Name:  "lisi",
-		Index: 1,
+	if err := initSyncs(cfg); err != nil {
+		log.Fatalf("init syncs fail:%v", err)
+		return
 	}
-
-	err = conn.Export(s, utils.ServicePath, utils.ServiceInterface)
-	if err != nil {
-		log.Fatalf("export service fail:%v", err)
+	if err := initKeys(cfg); err != nil {
+		log.Fatalf("init key owners fail:%v", err)
 		return
 	}
+	s := &Service{
+		ID:       "2",
+		Name:     "lisi",
+		Index:    1,
+		HasToken: len(tokens.Get()) != 0,
+		Jobs:     jobsProp(),
+		Online:   true,
+	}
 
 	props, err := utils.NewProperty(s)
 	if err != nil {
@@ -41,109 +45,537 @@ func initDbusService() {
 	}
 
 	mp, _ := utils.NewMulti()
-	p, _ := mp.Add(utils.ServiceInterface, s)
+	p, _ := mp.Add(cfg.Service.Interface, s)
+	serviceProps = p
+	svc = s
+	initNetwork()
+	jobs.Start()
+	startSyncs()
 
 	node := introspect.Node{
-		Name: utils.ServicePath,
+		Name: cfg.Service.Path,
 		Interfaces: []introspect.Interface{
 			{
-				Name:       utils.ServiceInterface,
+				Name:       cfg.Service.Interface,
 				Methods:    introspect.Methods(s),
 				Properties: p.Introspection(),
+				Signals:    serviceSignals,
 			},
 			props.Interface(),
 		},
 	}
-	err = conn.Export(introspect.NewIntrospectable(&node), utils.ServicePath, "org.freedesktop.DBus.Introspectable")
+
+	bus := utils.GetBus(cfg.Service.Bus)
+	// 总线重连后需要重新申请服务名并导出对象；token存储或网络监听可能已经建立了连接，此时立即导出并返回结果
+	err = bus.OnConnect(func(conn *dbus.Conn) error {
+		return exportService(conn, cfg, s, &node, mp)
+	})
+	if err == nil {
+		err = bus.Start()
+	}
+	if err != nil {
+		log.Fatalf("init %s bus service fail:%v", cfg.Service.Bus, err)
+		return
+	}
+	initLogin(s)
+}
+
+// emitSignal 发送Service信号
+func emitSignal(name string, values ...interface{}) {
+	cfg := utils.Conf()
+	conn, err := utils.GetBus(cfg.Service.Bus).Conn()
+	if err != nil {
+		log.Warnf("emit %s error:[%s]", name, err.Error())
+		return
+	}
+	err = conn.Emit(dbus.ObjectPath(cfg.Service.Path), cfg.Service.Interface+"."+name, values...)
 	if err != nil {
-		log.Fatalf("export service info to dbus fail:%v", err)
+		log.Warnf("emit %s error:[%s]", name, err.Error())
+	}
+}
+
+// emitSignalToUser 发送带有本地路径等信息的Service信号，系统总线上只发给uid用户的连接，会话总线上直接广播
+func emitSignalToUser(uid uint32, name string, values ...interface{}) {
+	cfg := utils.Conf()
+	if cfg.Service.Bus != utils.BusSystem {
+		emitSignal(name, values...)
 		return
 	}
-	err = mp.Export(conn, utils.ServicePath)
+	conn, err := utils.GetBus(cfg.Service.Bus).Conn()
 	if err != nil {
-		log.Fatalf("export service props to dbus fail:%v", err)
+		log.Warnf("emit %s error:[%s]", name, err.Error())
+		return
+	}
+	var names []string
+	if err := conn.BusObject().Call("org.freedesktop.DBus.ListNames", 0).Store(&names); err != nil {
+		log.Warnf("emit %s list names error:[%s]", name, err.Error())
 		return
 	}
+	for _, dest := range names {
+		// 只处理unique name，同一连接拥有的well-known name不重复发送，也不发给自己
+		if !strings.HasPrefix(dest, ":") || dest == conn.Names()[0] {
+			continue
+		}
+		if connUID, err := utils.GetConnUID(conn, dest); err != nil || connUID != uid {
+			continue
+		}
+		msg := &dbus.Message{
+			Type: dbus.TypeSignal,
+			Headers: map[dbus.HeaderField]dbus.Variant{
+				dbus.FieldPath:        dbus.MakeVariant(dbus.ObjectPath(cfg.Service.Path)),
+				dbus.FieldInterface:   dbus.MakeVariant(cfg.Service.Interface),
+				dbus.FieldMember:      dbus.MakeVariant(name),
+				dbus.FieldDestination: dbus.MakeVariant(dest),
+			},
+			Body: values,
+		}
+		if len(values) > 0 {
+			msg.Headers[dbus.FieldSignature] = dbus.MakeVariant(dbus.SignatureOf(values...))
+		}
+		conn.Send(msg, nil)
+	}
+}
+
+//
+// exportService
+//  @Description: 申请服务名并导出服务对象、introspection及属性
+//  @param conn
+//  @param cfg
+//  @param s
+//  @param node
+//  @param mp
+//  @return error
+//
+func exportService(conn *dbus.Conn, cfg *utils.Config, s *Service, node *introspect.Node, mp utils.MultiPropStruct) error {
+	reply, err := conn.RequestName(cfg.Service.Name, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		log.Errorf("query service name state fail:%v", err)
+		return err
+	} else if reply != dbus.RequestNameReplyPrimaryOwner {
+		log.Errorln("service name already exists!")
+		return errors.New("service name already exists")
+	}
+
+	err = conn.Export(s, dbus.ObjectPath(cfg.Service.Path), cfg.Service.Interface)
+	if err != nil {
+		log.Errorf("export service fail:%v", err)
+		return err
+	}
+	err = conn.Export(introspect.NewIntrospectable(node), dbus.ObjectPath(cfg.Service.Path), "org.freedesktop.DBus.Introspectable")
+	if err != nil {
+		log.Errorf("export service info to dbus fail:%v", err)
+		return err
+	}
+	err = mp.Export(conn, cfg.Service.Path)
+	if err != nil {
+		log.Errorf("export service props to dbus fail:%v", err)
+		return err
+	}
+	return nil
+}
+
+// authorizer 导出方法执行前的调用方鉴权
+var authorizer = utils.NewAuthorizer(utils.NewBusSenderResolver(), utils.NewPolkitChecker(nil))
+
+// serviceProps Service导出的属性，用于属性变更后发送PropertiesChanged信号
+var serviceProps utils.Property
+
+// svc 导出的Service对象，用于后台事件更新属性、发送信号
+var svc *Service
+
+// serviceSignals Service导出的信号
+var serviceSignals = []introspect.Signal{
+	{
+		Name: "LoginStateChanged",
+		Args: []introspect.Arg{
+			{Name: "loggedIn", Type: "b"},
+			{Name: "userInfo", Type: dbus.SignatureOf(utils.UserInfo{}).String()},
+		},
+	},
+	{
+		Name: "JobProgress",
+		Args: []introspect.Arg{
+			{Name: "id", Type: "s"},
+			{Name: "bytesDone", Type: "t"},
+			{Name: "bytesTotal", Type: "t"},
+		},
+	},
+	{
+		Name: "JobFinished",
+		Args: []introspect.Arg{
+			{Name: "id", Type: "s"},
+			{Name: "result", Type: "s"},
+		},
+	},
+	{
+		Name: "JobFailed",
+		Args: []introspect.Arg{
+			{Name: "id", Type: "s"},
+			{Name: "errorCode", Type: "i"},
+			{Name: "message", Type: "s"},
+		},
+	},
+	{
+		Name: "SyncConflict",
+		Args: []introspect.Arg{
+			{Name: "id", Type: "s"},
+			{Name: "path", Type: "s"},
+			{Name: "conflictPath", Type: "s"},
+		},
+	},
 }
 
 type Service struct {
-	ID    string `dbus:"const,emit"`
-	Name  string `dbus:"writeable,emit"`
-	Token string `dbus:"writeable,emit"`
-	Index int    `dbus:"writeable,emit"`
+	ID       string          `dbus:"const,emit"`
+	Name     string          `dbus:"writeable,emit"`
+	Index    int             `dbus:"writeable,emit"`
+	HasToken bool            `dbus:"emit"` //token只保存在安全存储中，不通过属性导出
+	UserInfo utils.UserInfo  `dbus:"emit"` //utcloud daemon当前登录的用户
+	Jobs     []utils.JobInfo `dbus:"emit"` //后台任务，状态变化时更新
+	Online   bool            `dbus:"emit"` //能否访问utcloud服务端，离线时上传和删除排队等待
 }
 
-func (s *Service) SetToken(value string) *dbus.Error {
-	s.Token = value
+// SetToken 设置云服务token，为空时清除
+func (s *Service) SetToken(sender dbus.Sender, value string) *dbus.Error {
+	if _, derr := authorizer.Authorize(string(sender), "SetToken"); derr != nil {
+		return derr
+	}
+	if err := tokens.Set(value, time.Time{}); err != nil {
+		return utils.NewError(err).Error
+	}
 	return nil
 }
 
-func (s *Service) Callback(sender dbus.Sender, mType int16, fName string, fSign string) (bool, *dbus.Error) {
-	path, err := utils.GetDbusSender(string(sender))
+// SetTokenWithExpiry 设置云服务token及有效期(秒)，过期前自动通过utcloud daemon刷新
+func (s *Service) SetTokenWithExpiry(sender dbus.Sender, value string, expiresIn int64) *dbus.Error {
+	if _, derr := authorizer.Authorize(string(sender), "SetToken"); derr != nil {
+		return derr
+	}
+	var expiresAt time.Time
+	if expiresIn > 0 {
+		expiresAt = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	}
+	if err := tokens.Set(value, expiresAt); err != nil {
+		return utils.NewError(err).Error
+	}
+	return nil
+}
+
+//
+// updateProp
+//  @Description: 在属性锁内修改属性值，修改后发送PropertiesChanged信号
+//  @param name 属性名
+//  @param value 新值
+//  @param set 修改属性的函数
+//
+func (s *Service) updateProp(name string, value interface{}, set func()) {
+	lock := serviceProps.Lock()
+	lock.Lock()
+	set()
+	lock.Unlock()
+	err := serviceProps.Emit(utils.Conf().Service.Interface, nil, map[string]interface{}{name: value})
 	if err != nil {
-		return false, utils.NewError(err).Error
+		log.Warnf("emit %s changed error:[%s]", name, err.Error())
+	}
+}
+
+func (s *Service) Callback(sender dbus.Sender, mType int16, fName string, fSign string) (bool, *dbus.Error) {
+	caller, derr := authorizer.Authorize(string(sender), "Callback")
+	if derr != nil {
+		return false, derr
 	}
 	log.WithFields(log.Fields{
-		"path":   path,
+		"path":   caller.Exe,
 		"method": "callback",
-	})
-	log.Debugf("回调接口推送信息为： %d %s %s", mType, fName, fSign)
+	}).Debugf("回调接口推送信息为： %d %s %s", mType, fName, fSign)
 	return true, nil
 }
 
 // AddWhitelist 给当前机器添加白名单
-func (s *Service) AddWhitelist() (bool, *dbus.Error) {
-	if len(s.Token) == 0 {
+func (s *Service) AddWhitelist(sender dbus.Sender) (bool, *dbus.Error) {
+	if _, derr := authorizer.Authorize(string(sender), "AddWhitelist"); derr != nil {
+		return false, derr
+	}
+	token := tokens.Get()
+	if len(token) == 0 {
 		log.Warn("not token found")
-		return false, utils.NewError(errors.New("token not found")).Error
+		return false, utils.NewError(utils.ErrNoToken).Error
+	}
+	if !network.Online() {
+		return false, utils.NewError(utils.ErrOffline).Error
 	}
-	osId, err := utils.AddOS(s.Token)
+	osId, err := utils.AddOS(token)
 	if err != nil {
 		return false, utils.NewError(err).Error
 	}
-	appId, err := utils.AddApp(s.Token)
+	appId, err := utils.AddApp(token)
 	if err != nil {
 		return false, utils.NewError(err).Error
 	}
-	ok, err := utils.BindApp2OS(s.Token, osId, appId)
+	ok, err := utils.BindApp2OS(token, osId, appId)
 	if err != nil {
 		return false, utils.NewError(err).Error
 	}
 	return ok, nil
 }
 
-//Upload 云服务上传文件
-func (s *Service) Upload(sender dbus.Sender, key string) ([]byte, *dbus.Error) {
-	path, err := utils.GetDbusSender(string(sender))
+// Reload 重新加载配置文件，返回需要重启服务才能生效的配置项
+func (s *Service) Reload(sender dbus.Sender) ([]string, *dbus.Error) {
+	if _, derr := authorizer.Authorize(string(sender), "Reload"); derr != nil {
+		return nil, derr
+	}
+	restart, err := reloadConfig()
 	if err != nil {
-		return []byte(""), utils.NewError(err).Error
+		return nil, utils.NewError(err).Error
 	}
-	bts, err := utils.UploadByDaemon(key)
+	return restart, nil
+}
+
+// SetBandwidthLimit 设置全局上传及下载限速(字节/秒)，优先于配置文件及按时段的限速，0不限速，-1恢复使用配置，重启后恢复为配置
+func (s *Service) SetBandwidthLimit(sender dbus.Sender, upload int64, download int64) *dbus.Error {
+	caller, derr := authorizer.Authorize(string(sender), "SetBandwidthLimit")
+	if derr != nil {
+		return derr
+	}
+	if upload < -1 || download < -1 {
+		return utils.NewError(utils.ErrInvalidParam).Error
+	}
+	utils.SetBandwidthLimit(upload, download)
+	log.WithFields(log.Fields{
+		"path":   caller.Exe,
+		"method": "SetBandwidthLimit",
+	}).Infof("bandwidth limit set to upload %d download %d", upload, download)
+	return nil
+}
+
+//Upload 云服务上传文件，任务提交后立即返回任务ID，上传在后台执行
+func (s *Service) Upload(sender dbus.Sender, key string) (string, *dbus.Error) {
+	caller, derr := authorizer.Authorize(string(sender), "Upload")
+	if derr != nil {
+		return "", derr
+	}
+	// 只允许上传调用方可以读取的文件
+	job, err := submitUpload(caller, key)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"path":   path,
+			"path":   caller.Exe,
 			"method": "Upload",
-		})
-		log.Errorf("上传出错，错误信息为：%#v %#v", bts, err)
-		return []byte(""), utils.NewError(err).Error
+		}).Errorf("提交上传任务出错，错误信息为：%#v", err)
+		return "", utils.NewError(err).Error
 	}
-	return bts, nil
+	return job.ID, nil
 }
 
-//Delete 云服务删除文件
-func (s *Service) Delete(sender dbus.Sender, key string) (string, *dbus.Error) {
-	path, err := utils.GetDbusSender(string(sender))
+//Download 云服务下载文件到localPath，任务提交后立即返回任务ID，下载在后台执行
+func (s *Service) Download(sender dbus.Sender, key string, localPath string) (string, *dbus.Error) {
+	caller, derr := authorizer.Authorize(string(sender), "Download")
+	if derr != nil {
+		return "", derr
+	}
+	if len(key) == 0 || len(localPath) == 0 {
+		return "", utils.NewError(utils.ErrInvalidParam).Error
+	}
+	if len(tokens.Get()) == 0 {
+		return "", utils.NewError(utils.ErrNoToken).Error
+	}
+	// 只允许调用方下载自己的key，写入自己的文件
+	if err := checkKey(caller.UID, key); err != nil {
+		return "", utils.NewError(err).Error
+	}
+	if err := utils.CheckFileOwner(localPath, caller.UID); err != nil {
+		return "", utils.NewError(err).Error
+	}
+	if err := utils.CheckWriteFile(utils.WithOwner(context.Background(), caller.UID), localPath); err != nil {
+		return "", utils.NewError(err).Error
+	}
+	job, err := jobs.Submit(utils.JobDownload, key, localPath, caller.UID)
 	if err != nil {
+		log.WithFields(log.Fields{
+			"path":   caller.Exe,
+			"method": "Download",
+		}).Errorf("提交下载任务出错，错误信息为：%#v", err)
+		return "", utils.NewError(err).Error
+	}
+	return job.ID, nil
+}
+
+//Delete 云服务删除文件，离线时提交删除任务并返回任务ID，恢复联网后自动执行
+func (s *Service) Delete(sender dbus.Sender, key string) (string, *dbus.Error) {
+	caller, derr := authorizer.Authorize(string(sender), "Delete")
+	if derr != nil {
+		return "", derr
+	}
+	// 只允许调用方删除自己的key
+	if err := checkKey(caller.UID, key); err != nil {
 		return "", utils.NewError(err).Error
 	}
-	str, err := utils.DeleteByDaemon(key)
+	var str string
+	var err error
+	if network.Online() {
+		str, err = deleteFile(key)
+	} else {
+		str, err = deferDelete(key, caller.UID)
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
-			"path":   path,
+			"path":   caller.Exe,
 			"method": "Delete",
-		})
-		log.Errorf("删除出错，错误信息为: %#v", err)
+		}).Errorf("删除出错，错误信息为: %#v", err)
 		return "", utils.NewError(err).Error
 	}
 	return str, nil
 }
+
+//ListJobs 获取调用方提交的后台任务，root获取所有任务
+func (s *Service) ListJobs(sender dbus.Sender) ([]utils.JobInfo, *dbus.Error) {
+	caller, derr := authorizer.Authorize(string(sender), "ListJobs")
+	if derr != nil {
+		return nil, derr
+	}
+	return jobInfos(caller.UID), nil
+}
+
+//GetJob 获取调用方提交的后台任务
+func (s *Service) GetJob(sender dbus.Sender, id string) (utils.JobInfo, *dbus.Error) {
+	caller, derr := authorizer.Authorize(string(sender), "GetJob")
+	if derr != nil {
+		return utils.JobInfo{}, derr
+	}
+	job, err := ownJob(caller, id)
+	if err != nil {
+		return utils.JobInfo{}, utils.NewError(err).Error
+	}
+	return job.Info(), nil
+}
+
+//CancelJob 取消后台任务，正在执行的传输会被中断
+func (s *Service) CancelJob(sender dbus.Sender, id string) *dbus.Error {
+	caller, derr := authorizer.Authorize(string(sender), "CancelJob")
+	if derr != nil {
+		return derr
+	}
+	if _, err := ownJob(caller, id); err != nil {
+		return utils.NewError(err).Error
+	}
+	if _, err := jobs.Cancel(id); err != nil {
+		return utils.NewError(err).Error
+	}
+	log.WithFields(log.Fields{
+		"path":   caller.Exe,
+		"method": "CancelJob",
+	}).Infof("取消任务%s", id)
+	return nil
+}
+
+//RetryJob 重新执行失败或已取消的后台任务
+func (s *Service) RetryJob(sender dbus.Sender, id string) *dbus.Error {
+	caller, derr := authorizer.Authorize(string(sender), "RetryJob")
+	if derr != nil {
+		return derr
+	}
+	if _, err := ownJob(caller, id); err != nil {
+		return utils.NewError(err).Error
+	}
+	if _, err := jobs.Retry(id); err != nil {
+		return utils.NewError(err).Error
+	}
+	return nil
+}
+
+//UploadMany 批量提交上传任务，与Upload一样在后台上传，返回每个key是否提交成功，任务ID通过UploadManyWithJobs获取
+func (s *Service) UploadMany(sender dbus.Sender, keys []string) ([]BatchResult, *dbus.Error) {
+	results, derr := uploadMany(sender, keys)
+	return withoutJobIDs(results), derr
+}
+
+//UploadManyWithJobs 与UploadMany相同，同时返回每个key的任务ID
+func (s *Service) UploadManyWithJobs(sender dbus.Sender, keys []string) ([]BatchJobResult, *dbus.Error) {
+	return uploadMany(sender, keys)
+}
+
+//DeleteMany 批量删除云端文件，返回每个key的删除结果，离线时提交删除任务，恢复联网后自动执行
+func (s *Service) DeleteMany(sender dbus.Sender, keys []string) ([]BatchResult, *dbus.Error) {
+	results, derr := deleteMany(sender, keys)
+	return withoutJobIDs(results), derr
+}
+
+//DeleteManyWithJobs 与DeleteMany相同，离线时同时返回每个key的删除任务ID
+func (s *Service) DeleteManyWithJobs(sender dbus.Sender, keys []string) ([]BatchJobResult, *dbus.Error) {
+	return deleteMany(sender, keys)
+}
+
+//AddSync 注册单向同步目录，目录中的文件会同步到云端prefix下，返回同步目录ID
+func (s *Service) AddSync(sender dbus.Sender, dir string, prefix string) (string, *dbus.Error) {
+	caller, derr := authorizer.Authorize(string(sender), "AddSync")
+	if derr != nil {
+		return "", derr
+	}
+	id, err := addSync(caller, dir, prefix, utils.SyncUpload)
+	if err != nil {
+		return "", utils.NewError(err).Error
+	}
+	return id, nil
+}
+
+//AddSyncWithMode 注册同步目录，mode为upload(单向同步到云端)或twoway(双向同步)，返回同步目录ID
+func (s *Service) AddSyncWithMode(sender dbus.Sender, dir string, prefix string, mode string) (string, *dbus.Error) {
+	caller, derr := authorizer.Authorize(string(sender), "AddSync")
+	if derr != nil {
+		return "", derr
+	}
+	id, err := addSync(caller, dir, prefix, mode)
+	if err != nil {
+		return "", utils.NewError(err).Error
+	}
+	return id, nil
+}
+
+//RemoveSync 取消同步目录，云端已同步的文件保留
+func (s *Service) RemoveSync(sender dbus.Sender, id string) *dbus.Error {
+	caller, derr := authorizer.Authorize(string(sender), "RemoveSync")
+	if derr != nil {
+		return derr
+	}
+	if _, err := ownSync(caller, id); err != nil {
+		return utils.NewError(err).Error
+	}
+	if err := syncs.remove(id); err != nil {
+		return utils.NewError(err).Error
+	}
+	return nil
+}
+
+//ListSyncs 获取调用方注册的同步目录，root获取所有同步目录
+func (s *Service) ListSyncs(sender dbus.Sender) ([]SyncFolder, *dbus.Error) {
+	caller, derr := authorizer.Authorize(string(sender), "ListSyncs")
+	if derr != nil {
+		return nil, derr
+	}
+	folders := []SyncFolder{}
+	for _, folder := range syncs.list() {
+		if caller.UID == 0 || folder.UID == caller.UID {
+			folders = append(folders, folder)
+		}
+	}
+	return folders, nil
+}
+
+//SyncNow 立即同步目录，返回同步任务ID
+func (s *Service) SyncNow(sender dbus.Sender, id string) (string, *dbus.Error) {
+	caller, derr := authorizer.Authorize(string(sender), "SyncNow")
+	if derr != nil {
+		return "", derr
+	}
+	folder, err := ownSync(caller, id)
+	if err != nil {
+		return "", utils.NewError(err).Error
+	}
+	if len(tokens.Get()) == 0 {
+		return "", utils.NewError(utils.ErrNoToken).Error
+	}
+	job, err := submitSync(folder)
+	if err != nil {
+		return "", utils.NewError(err).Error
+	}
+	return job.ID, nil
+}
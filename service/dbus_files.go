@@ -0,0 +1,151 @@
+package service
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/jibenliu/utMsgDaemon/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	systemPolicyDir      = "/etc/dbus-1/system.d"
+	systemActivationDir  = "/usr/share/dbus-1/system-services"
+	sessionActivationDir = "/usr/share/dbus-1/services"
+	polkitActionDir      = "/usr/share/polkit-1/actions"
+)
+
+// dbus总线访问策略，只允许root占用服务名，所有用户均可调用
+const policyTemplate = `<!DOCTYPE busconfig PUBLIC
+ "-//freedesktop//DTD D-BUS Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <policy user="root">
+    <allow own="{{.Name}}"/>
+  </policy>
+  <policy context="default">
+    <allow send_destination="{{.Name}}"/>
+    <allow receive_sender="{{.Name}}"/>
+  </policy>
+</busconfig>
+`
+
+// dbus按需激活文件，system模式下交由systemd拉起
+const activationTemplate = `[D-BUS Service]
+Name={{.Name}}
+Exec={{.Exec}}
+{{- if .System}}
+User=root
+SystemdService={{.Unit}}.service
+{{- end}}
+`
+
+// polkit action定义，每个需要授权的方法对应一个action
+const polkitTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE policyconfig PUBLIC
+ "-//freedesktop//DTD PolicyKit Policy Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/PolicyKit/1/policyconfig.dtd">
+<policyconfig>
+  <vendor>UnionTech</vendor>
+{{- range .Actions}}
+  <action id="{{$.Name}}.{{.Suffix}}">
+    <description>{{.Description}}</description>
+    <message>{{.Message}}</message>
+    <defaults>
+      <allow_any>auth_admin</allow_any>
+      <allow_inactive>auth_admin</allow_inactive>
+      <allow_active>auth_admin_keep</allow_active>
+    </defaults>
+  </action>
+{{- end}}
+</policyconfig>
+`
+
+type dbusFileInfo struct {
+	Name    string
+	Exec    string
+	Unit    string
+	System  bool
+	Actions []utils.PolkitAction
+}
+
+//
+// installDBusFiles
+//  @Description: 安装服务时生成dbus策略、激活文件及polkit action定义
+//  @param unit 服务管理器中的服务名
+//  @param args 服务启动参数
+//  @return error
+//
+func installDBusFiles(unit string, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cfg := utils.Conf()
+	info := dbusFileInfo{
+		Name:    cfg.Service.Name,
+		Exec:    strings.Join(append([]string{exe}, args...), " "),
+		Unit:    unit,
+		System:  cfg.Service.Bus == utils.BusSystem,
+		Actions: utils.PolkitActions(),
+	}
+	policy, activation, action := dbusFilePaths(cfg)
+	if len(policy) != 0 {
+		if err := writeTemplate(policy, policyTemplate, info); err != nil {
+			return err
+		}
+	}
+	if len(action) != 0 {
+		if err := writeTemplate(action, polkitTemplate, info); err != nil {
+			return err
+		}
+	}
+	return writeTemplate(activation, activationTemplate, info)
+}
+
+// removeDBusFiles 卸载服务时删除dbus策略、激活文件及polkit action定义
+func removeDBusFiles() {
+	policy, activation, action := dbusFilePaths(utils.Conf())
+	for _, item := range []string{policy, activation, action} {
+		if len(item) == 0 {
+			continue
+		}
+		if err := os.Remove(item); err != nil && !os.IsNotExist(err) {
+			log.Warnf("remove %s error:[%s]", item, err.Error())
+		}
+	}
+}
+
+// dbusFilePaths 获取策略文件、激活文件及polkit action文件路径，session总线不需要策略及polkit action文件
+func dbusFilePaths(cfg *utils.Config) (policy string, activation string, action string) {
+	if cfg.Service.Bus == utils.BusSystem {
+		policy = filepath.Join(systemPolicyDir, cfg.Service.Name+".conf")
+		activation = filepath.Join(systemActivationDir, cfg.Service.Name+".service")
+		action = filepath.Join(polkitActionDir, cfg.Service.Name+".policy")
+		return
+	}
+	activation = filepath.Join(sessionActivationDir, cfg.Service.Name+".service")
+	return
+}
+
+func writeTemplate(file, text string, data interface{}) error {
+	tpl, err := template.New(filepath.Base(file)).Parse(text)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return err
+	}
+	if err := utils.MakeDir(filepath.Dir(file)); err != nil {
+		return err
+	}
+	if err := os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	log.Infof("write %s", file)
+	return nil
+}
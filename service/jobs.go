@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/jibenliu/utMsgDaemon/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// jobs 后台任务队列
+var jobs *utils.JobQueue
+
+//
+// initJobs
+//  @Description: 加载任务日志并注册任务处理函数，导出服务后再调用jobs.Start继续执行上次未完成的任务
+//  @param cfg
+//  @return error
+//
+func initJobs(cfg *utils.Config) error {
+	q, err := utils.NewJobQueue(cfg.StatePath("jobs.json"), cfg.Jobs.Workers, cfg.Jobs.Keep)
+	if err != nil {
+		return err
+	}
+	q.Handle(utils.JobUpload, uploadJob)
+	q.Handle(utils.JobDownload, downloadJob)
+	q.Handle(utils.JobDelete, deleteJob)
+	q.OnChange(emitJob)
+	q.OnProgress(emitJobProgress)
+	jobs = q
+	return nil
+}
+
+// jobInfos 获取uid提交的任务信息，uid为0时获取所有任务
+func jobInfos(uid uint32) []utils.JobInfo {
+	list := jobs.List()
+	infos := make([]utils.JobInfo, 0, len(list))
+	for i := range list {
+		if uid == 0 || list[i].UID == uid {
+			infos = append(infos, list[i].Info())
+		}
+	}
+	return infos
+}
+
+// jobsProp Jobs属性的值，系统总线上所有用户都能读取，隐藏key、本地路径及结果，只保留状态和进度
+func jobsProp() []utils.JobInfo {
+	infos := jobInfos(0)
+	if utils.Conf().Service.Bus != utils.BusSystem {
+		return infos
+	}
+	for i := range infos {
+		infos[i].Key = ""
+		infos[i].LocalPath = ""
+		infos[i].Result = ""
+		infos[i].Error = ""
+	}
+	return infos
+}
+
+// ownJob 获取调用方提交的任务，root可以访问所有任务，其他用户的任务按不存在处理
+func ownJob(caller *utils.Caller, id string) (utils.Job, error) {
+	job, has := jobs.Get(id)
+	if !has || (caller.UID != 0 && job.UID != caller.UID) {
+		return utils.Job{}, utils.ErrJobNotFound
+	}
+	return job, nil
+}
+
+// submitUpload 检查调用方能否读取文件、能否覆盖云端key后提交上传任务
+func submitUpload(caller *utils.Caller, key string) (utils.Job, error) {
+	if err := utils.CheckReadFile(key, caller.UID); err != nil {
+		return utils.Job{}, err
+	}
+	if err := checkUploadKey(caller.UID, key); err != nil {
+		return utils.Job{}, err
+	}
+	return jobs.Submit(utils.JobUpload, key, key, caller.UID)
+}
+
+// uploadJob 上传文件，utcloud daemon不提供进度，通过utcloud daemon上传时只在开始和结束时上报；
+// 文件超过当前时段允许的大小时推迟到时段结束；提交后文件可能已被替换，执行时重新检查提交任务的用户能否读取，
+// 直接上传时也以该用户的权限打开文件
+func uploadJob(ctx context.Context, job *utils.Job, progress utils.ProgressFunc) (string, error) {
+	log.Debugf("upload job %s start, key:[%s]", job.ID, job.Key)
+	if err := utils.CheckReadFile(job.LocalPath, job.UID); err != nil {
+		return "", err
+	}
+	if err := checkUploadKey(job.UID, job.Key); err != nil {
+		return "", err
+	}
+	size, _ := utils.FileSize(ctx, job.LocalPath)
+	if until, deferred := utils.UploadDeferredUntil(size, time.Now()); deferred {
+		return "", &utils.DeferredError{Until: until}
+	}
+	progress(0, size)
+	result, err := uploadFile(ctx, job.Key, progress)
+	if err != nil {
+		return "", err
+	}
+	keyOwners.set(job.Key, job.UID)
+	progress(size, size)
+	return result, nil
+}
+
+// downloadJob 通过临时授权下载文件，返回本地文件路径；提交后路径可能已被替换，执行时重新检查属主，
+// 文件以提交任务的用户的权限创建
+func downloadJob(ctx context.Context, job *utils.Job, progress utils.ProgressFunc) (string, error) {
+	log.Debugf("download job %s start, key:[%s] path:[%s]", job.ID, job.Key, job.LocalPath)
+	token := tokens.Get()
+	if len(token) == 0 {
+		return "", utils.ErrNoToken
+	}
+	if err := checkKey(job.UID, job.Key); err != nil {
+		return "", err
+	}
+	if err := utils.CheckFileOwner(job.LocalPath, job.UID); err != nil {
+		return "", err
+	}
+	err := utils.DownloadUtDaemon(ctx, token, job.Key, job.LocalPath, progress)
+	if err != nil {
+		return "", err
+	}
+	return job.LocalPath, nil
+}
+
+// emitJobProgress 任务进度变化时发送信号
+func emitJobProgress(job utils.Job) {
+	emitSignal("JobProgress", job.ID, uint64(job.BytesDone), uint64(job.BytesTotal))
+}
+
+// emitJob 任务状态变化时更新Jobs属性，结束时向提交任务的用户发送信号
+func emitJob(job utils.Job) {
+	infos := jobsProp()
+	svc.updateProp("Jobs", infos, func() {
+		svc.Jobs = infos
+	})
+	switch job.State {
+	case utils.JobDone:
+		emitSignalToUser(job.UID, "JobFinished", job.ID, job.Result)
+	case utils.JobFailed:
+		emitSignalToUser(job.UID, "JobFailed", job.ID, job.ErrorCode, job.Error)
+	}
+}
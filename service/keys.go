@@ -0,0 +1,155 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jibenliu/utMsgDaemon/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+var errKeyNotOwned = &utils.Error{Kind: utils.KindPermissionDenied, Code: -1, Message: "key belongs to another user"}
+
+//keyRegistry 记录system总线上Upload上传的云端key属于哪个用户，持久化到状态目录；
+//所有用户共用一个token及key空间，非root用户只能访问自己的key
+type keyRegistry struct {
+	mut    sync.Mutex
+	file   string
+	owners map[string]uint32
+}
+
+var keyOwners = &keyRegistry{owners: map[string]uint32{}}
+
+// initKeys 加载云端key的上传用户
+func initKeys(cfg *utils.Config) error {
+	keyOwners.file = cfg.StatePath("keys.json")
+	owners := map[string]uint32{}
+	data, err := ioutil.ReadFile(keyOwners.file)
+	if err == nil {
+		err = json.Unmarshal(data, &owners)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if owners == nil {
+		owners = map[string]uint32{}
+	}
+	keyOwners.owners = owners
+	return nil
+}
+
+func (r *keyRegistry) owner(key string) (uint32, bool) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	uid, has := r.owners[key]
+	return uid, has
+}
+
+// set 上传成功后记录key属于uid用户，只在system总线上记录
+func (r *keyRegistry) set(key string, uid uint32) {
+	if utils.Conf().Service.Bus != utils.BusSystem {
+		return
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if old, has := r.owners[key]; has && old == uid {
+		return
+	}
+	r.owners[key] = uid
+	if err := r.save(); err != nil {
+		log.Errorf("save key owners error:[%s]", err.Error())
+	}
+}
+
+// remove 云端删除成功后删除记录
+func (r *keyRegistry) remove(key string) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if _, has := r.owners[key]; !has {
+		return
+	}
+	delete(r.owners, key)
+	if err := r.save(); err != nil {
+		log.Errorf("save key owners error:[%s]", err.Error())
+	}
+}
+
+func (r *keyRegistry) save() error {
+	data, err := json.Marshal(r.owners)
+	if err != nil {
+		return err
+	}
+	if err := utils.MakeDir(filepath.Dir(r.file)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.file, data, 0600)
+}
+
+//
+// checkKey
+//  @Description: 检查uid用户能否下载、删除云端key，session总线及root不做限制；
+//  Upload上传的key属于上传的用户，同步目录prefix下的key属于注册该目录的用户，其余key(如升级前上传的)只有root可以访问
+//  @param uid
+//  @param key
+//  @return error
+//
+func checkKey(uid uint32, key string) error {
+	if uid == 0 || utils.Conf().Service.Bus != utils.BusSystem {
+		return nil
+	}
+	if owner, has := keyOwners.owner(key); has {
+		if owner != uid {
+			return errKeyNotOwned
+		}
+		return nil
+	}
+	for _, folder := range syncs.list() {
+		if strings.HasPrefix(key, utils.RemoteKey(folder.Prefix, "")) {
+			if folder.UID != uid {
+				return errKeyNotOwned
+			}
+			return nil
+		}
+	}
+	return errKeyNotOwned
+}
+
+// checkUploadKey 检查uid用户能否上传到key(即本地路径)：key没有上传过、属于该用户，或者本地文件属于该用户时允许
+func checkUploadKey(uid uint32, key string) error {
+	if uid == 0 || utils.Conf().Service.Bus != utils.BusSystem {
+		return nil
+	}
+	owner, has := keyOwners.owner(key)
+	if !has || owner == uid {
+		return nil
+	}
+	// 文件属主可以覆盖其他用户上传的同名key
+	if fileUID, err := utils.FileOwner(key); err == nil && fileUID == uid {
+		return nil
+	}
+	return errKeyNotOwned
+}
+
+// checkPrefix 非root用户的同步prefix不能与其他用户的同步prefix重叠，session总线不做限制
+func checkPrefix(uid uint32, prefix string) error {
+	if uid == 0 || utils.Conf().Service.Bus != utils.BusSystem {
+		return nil
+	}
+	for _, folder := range syncs.list() {
+		if folder.UID != uid && prefixOverlap(folder.Prefix, prefix) {
+			return errKeyNotOwned
+		}
+	}
+	return nil
+}
+
+//----------------------辅助函数------------------------
+
+//prefixOverlap 两个prefix相同或一个在另一个之下
+func prefixOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jibenliu/utMsgDaemon/utils"
+)
+
+const (
+	alice uint32 = 1000
+	bob   uint32 = 1001
+)
+
+//setKeysTestConf 使用临时状态目录，注册alice的同步目录，测试结束后恢复
+func setKeysTestConf(t *testing.T, bus string) *utils.Config {
+	old := utils.Conf()
+	oldKeys, oldFolders := keyOwners.owners, syncs.folders
+	t.Cleanup(func() {
+		utils.SetConf(old)
+		keyOwners.owners, syncs.folders = oldKeys, oldFolders
+	})
+	c := utils.DefaultConfig()
+	c.Service.Bus = bus
+	c.StateDir = t.TempDir()
+	utils.SetConf(c)
+	if err := initKeys(c); err != nil {
+		t.Fatal(err)
+	}
+	syncs.folders = []SyncFolder{{ID: "s1", Dir: "/home/alice/docs", Prefix: "alice/docs", Mode: utils.SyncUpload, UID: alice}}
+	return c
+}
+
+func TestCheckKey(t *testing.T) {
+	cfg := setKeysTestConf(t, utils.BusSystem)
+	keyOwners.set("/home/alice/a.txt", alice)
+	keyOwners.set("/home/bob/b.txt", bob)
+
+	cases := []struct {
+		name string
+		uid  uint32
+		key  string
+		ok   bool
+	}{
+		{name: "own upload", uid: alice, key: "/home/alice/a.txt", ok: true},
+		{name: "other upload", uid: bob, key: "/home/alice/a.txt"},
+		{name: "other upload reversed", uid: alice, key: "/home/bob/b.txt"},
+		{name: "root any upload", uid: 0, key: "/home/bob/b.txt", ok: true},
+		{name: "unknown key", uid: alice, key: "/home/alice/old.txt"},
+		{name: "root unknown key", uid: 0, key: "/home/alice/old.txt", ok: true},
+		{name: "own sync prefix", uid: alice, key: "alice/docs/x/y.txt", ok: true},
+		{name: "other sync prefix", uid: bob, key: "alice/docs/x/y.txt"},
+		{name: "similar prefix", uid: alice, key: "alice/docsx/y.txt"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkKey(tc.uid, tc.key)
+			if tc.ok && err != nil {
+				t.Fatalf("expect allowed, got %v", err)
+			}
+			if !tc.ok && err != errKeyNotOwned {
+				t.Fatalf("expect %v, got %v", errKeyNotOwned, err)
+			}
+		})
+	}
+
+	// 记录持久化，重启后仍然生效
+	keyOwners.owners = nil
+	if err := initKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkKey(bob, "/home/alice/a.txt"); err != errKeyNotOwned {
+		t.Fatalf("expect %v after reload, got %v", errKeyNotOwned, err)
+	}
+
+	// 删除后只有root可以访问
+	keyOwners.remove("/home/alice/a.txt")
+	if err := checkKey(alice, "/home/alice/a.txt"); err != errKeyNotOwned {
+		t.Fatalf("expect %v after remove, got %v", errKeyNotOwned, err)
+	}
+}
+
+func TestCheckUploadKey(t *testing.T) {
+	setKeysTestConf(t, utils.BusSystem)
+	file := filepath.Join(t.TempDir(), "shared.txt")
+	if err := ioutil.WriteFile(file, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if os.Geteuid() == 0 {
+		if err := os.Chown(file, int(bob), int(bob)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileUID, err := utils.FileOwner(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileUID == alice {
+		t.Skip("test file owned by alice")
+	}
+
+	if err := checkUploadKey(alice, file); err != nil {
+		t.Fatalf("expect new key allowed, got %v", err)
+	}
+	keyOwners.set(file, alice)
+	if err := checkUploadKey(alice, file); err != nil {
+		t.Fatalf("expect own key allowed, got %v", err)
+	}
+	// 文件属主可以覆盖，其他用户不能
+	if err := checkUploadKey(fileUID, file); err != nil {
+		t.Fatalf("expect file owner allowed, got %v", err)
+	}
+	if other := fileUID + 1; other != alice {
+		if err := checkUploadKey(other, file); err != errKeyNotOwned {
+			t.Fatalf("expect %v, got %v", errKeyNotOwned, err)
+		}
+	}
+}
+
+func TestCheckPrefix(t *testing.T) {
+	setKeysTestConf(t, utils.BusSystem)
+	cases := []struct {
+		name   string
+		uid    uint32
+		prefix string
+		ok     bool
+	}{
+		{name: "same prefix of other", uid: bob, prefix: "alice/docs"},
+		{name: "parent of other", uid: bob, prefix: "alice"},
+		{name: "child of other", uid: bob, prefix: "alice/docs/sub"},
+		{name: "disjoint", uid: bob, prefix: "bob/docs", ok: true},
+		{name: "similar name", uid: bob, prefix: "alice/docsx", ok: true},
+		{name: "own prefix", uid: alice, prefix: "alice/docs/sub", ok: true},
+		{name: "root", uid: 0, prefix: "alice", ok: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkPrefix(tc.uid, tc.prefix)
+			if tc.ok && err != nil {
+				t.Fatalf("expect allowed, got %v", err)
+			}
+			if !tc.ok && err != errKeyNotOwned {
+				t.Fatalf("expect %v, got %v", errKeyNotOwned, err)
+			}
+		})
+	}
+}
+
+func TestCheckKeySessionBus(t *testing.T) {
+	setKeysTestConf(t, utils.BusSession)
+	keyOwners.set("/home/alice/a.txt", alice)
+	if _, has := keyOwners.owner("/home/alice/a.txt"); has {
+		t.Fatal("key owner should not be recorded on session bus")
+	}
+	if err := checkKey(bob, "alice/docs/a.txt"); err != nil {
+		t.Fatalf("expect no restriction on session bus, got %v", err)
+	}
+	if err := checkPrefix(bob, "alice/docs"); err != nil {
+		t.Fatalf("expect no restriction on session bus, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"github.com/jibenliu/utMsgDaemon/utils"
 	log "github.com/sirupsen/logrus"
 	"os"
 )
@@ -19,3 +20,13 @@ func init() {
 		TimestampFormat: "2006-01-02 15:04:05",
 	})
 }
+
+// applyLogLevel 按配置设置日志级别
+func applyLogLevel(cfg *utils.Config) {
+	level, err := log.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		log.Warnf("invalid log level %q, keep %s", cfg.Log.Level, log.GetLevel())
+		return
+	}
+	log.SetLevel(level)
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jibenliu/utMsgDaemon/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	loginLock  sync.Mutex
+	loginKnown bool //是否已获取过utcloud daemon的登录状态
+	loggedIn   bool
+)
+
+//
+// initLogin
+//  @Description: token变化时更新HasToken，监听utcloud daemon的登录状态
+//  @param s
+//
+func initLogin(s *Service) {
+	tokens.mut.Lock()
+	tokens.onChange = func(hasToken bool) {
+		s.updateProp("HasToken", hasToken, func() {
+			s.HasToken = hasToken
+		})
+	}
+	tokens.mut.Unlock()
+
+	err := utils.WatchUserInfo(func(info utils.UserInfo) {
+		onUserInfo(s, info)
+	})
+	if err != nil {
+		log.Warnf("watch utcloud user info error:[%s]", err.Error())
+	}
+}
+
+//
+// onUserInfo
+//  @Description: utcloud daemon登录用户变化，观察到从登录变为登出时作废token，登录且没有token时尝试从utcloud daemon获取；
+//  启动时看到的未登录状态不作废token，避免每次重启都清除通过SetToken设置的token
+//  @param s
+//  @param info
+//
+func onUserInfo(s *Service, info utils.UserInfo) {
+	login := info.IsLoggedIn && info.IsValid()
+	s.updateProp("UserInfo", info, func() {
+		s.UserInfo = info
+	})
+
+	loginLock.Lock()
+	logout := loginKnown && loggedIn && !login
+	changed := !loginKnown || loggedIn != login
+	loginKnown = true
+	loggedIn = login
+	loginLock.Unlock()
+	if !changed {
+		return
+	}
+	log.Infof("utcloud login state changed: %v", login)
+	if logout && len(tokens.Get()) != 0 {
+		if err := tokens.Set("", time.Time{}); err != nil {
+			log.Errorf("invalidate token error:[%s]", err.Error())
+		}
+	} else if login && len(tokens.Get()) == 0 {
+		if token, err := utils.GetTokenByDaemon(); err == nil && len(token) != 0 {
+			_ = tokens.Set(token, time.Time{})
+		}
+	}
+	emitSignal("LoginStateChanged", login, info)
+}
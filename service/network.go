@@ -0,0 +1,54 @@
+package service
+
+import (
+	"context"
+
+	"github.com/jibenliu/utMsgDaemon/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// network 网络状态检测
+var network *utils.NetworkMonitor
+
+//
+// initNetwork
+//  @Description: 开始检测网络状态，离线时暂停任务队列，恢复联网后继续执行排队的上传、删除等任务
+//
+func initNetwork() {
+	network = utils.NewNetworkMonitor(setOnline)
+	jobs.OnOffline(recheckNetwork)
+	network.Start()
+}
+
+// recheckNetwork 任务因网络不可用失败时任务队列已暂停，重新探测后按结果暂停或恢复；
+// 服务端可达但对象存储访问超时等情况下在线状态不变，不会触发setOnline，需要在这里恢复
+func recheckNetwork() {
+	jobs.SetPaused(!network.Probe())
+}
+
+// setOnline 在线状态变化时更新Online属性并暂停或恢复任务队列
+func setOnline(online bool) {
+	jobs.SetPaused(!online)
+	svc.updateProp("Online", online, func() {
+		svc.Online = online
+	})
+}
+
+// deferDelete 离线时以uid用户的身份提交删除任务，恢复联网后执行，返回任务ID
+func deferDelete(key string, uid uint32) (string, error) {
+	job, err := jobs.Submit(utils.JobDelete, key, "", uid)
+	if err != nil {
+		return "", err
+	}
+	log.Infof("network offline, delete %s deferred as job %s", key, job.ID)
+	return job.ID, nil
+}
+
+// deleteJob 执行离线时提交的删除
+func deleteJob(_ context.Context, job *utils.Job, _ utils.ProgressFunc) (string, error) {
+	log.Debugf("delete job %s start, key:[%s]", job.ID, job.Key)
+	if err := checkKey(job.UID, job.Key); err != nil {
+		return "", err
+	}
+	return deleteFile(job.Key)
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/jibenliu/utMsgDaemon/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	configFile string     //启动时指定的配置文件路径(绝对路径)
+	reloadLock sync.Mutex //防止SIGHUP与dbus调用同时重载
+)
+
+//
+// reloadConfig
+//  @Description: 重新加载配置文件并应用可热更新的配置项(日志级别、服务端地址、应用信息、超时时间、限速等)；
+//  utcloud daemon的总线、服务名、路径及接口名用于监听登录状态，只在启动时订阅
+//  @return []string 需要重启才能生效的配置项，这些配置项仍保持原值
+//  @return error
+//
+func reloadConfig() ([]string, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	cfg, err := utils.LoadConfig(configFile)
+	if err != nil {
+		log.Errorf("reload config error:[%s]", err.Error())
+		return nil, err
+	}
+	old := utils.Conf()
+	restart := restartRequired(old, cfg)
+	for _, key := range restart {
+		log.Warnf("config %s changed, restart required", key)
+	}
+	keepStartupConfig(old, cfg)
+	utils.SetConf(cfg)
+	applyLogLevel(cfg)
+	log.Info("config reloaded")
+	return restart, nil
+}
+
+// restartRequired 对比新旧配置，返回不能热更新的配置项
+func restartRequired(old, cfg *utils.Config) []string {
+	restart := make([]string, 0)
+	if old.StateDir != cfg.StateDir {
+		restart = append(restart, "state_dir")
+	}
+	if old.Service.Bus != cfg.Service.Bus {
+		restart = append(restart, "service.bus")
+	}
+	if old.Service.Name != cfg.Service.Name {
+		restart = append(restart, "service.name")
+	}
+	if old.Service.Path != cfg.Service.Path {
+		restart = append(restart, "service.path")
+	}
+	if old.Service.Interface != cfg.Service.Interface {
+		restart = append(restart, "service.interface")
+	}
+	if old.Utcloud.DBusBus != cfg.Utcloud.DBusBus {
+		restart = append(restart, "utcloud.dbus_bus")
+	}
+	if old.Utcloud.DBusService != cfg.Utcloud.DBusService {
+		restart = append(restart, "utcloud.dbus_service")
+	}
+	if old.Utcloud.DBusPath != cfg.Utcloud.DBusPath {
+		restart = append(restart, "utcloud.dbus_path")
+	}
+	if old.Utcloud.DBusIface != cfg.Utcloud.DBusIface {
+		restart = append(restart, "utcloud.dbus_interface")
+	}
+	if old.Jobs.Workers != cfg.Jobs.Workers {
+		restart = append(restart, "jobs.workers")
+	}
+	if old.Jobs.Keep != cfg.Jobs.Keep {
+		restart = append(restart, "jobs.keep")
+	}
+	if old.Token.Store != cfg.Token.Store {
+		restart = append(restart, "token.store")
+	}
+	if old.Token.File != cfg.Token.File {
+		restart = append(restart, "token.file")
+	}
+	if old.Sync.Watch != cfg.Sync.Watch {
+		restart = append(restart, "sync.watch")
+	}
+	if old.Network.ProbeInterval != cfg.Network.ProbeInterval {
+		restart = append(restart, "network.probe_interval")
+	}
+	return restart
+}
+
+//keepStartupConfig 只在启动时读取的配置项保持原值，与restartRequired对应；
+//状态目录变化时任务日志、同步清单等文件路径不能只切换一部分
+func keepStartupConfig(old, cfg *utils.Config) {
+	// 总线上已占用的服务名不能热更新
+	cfg.Service = old.Service
+	cfg.StateDir = old.StateDir
+	// UserInfo的监听在启动时订阅，获取token也需要使用同一个utcloud daemon
+	cfg.Utcloud.DBusBus = old.Utcloud.DBusBus
+	cfg.Utcloud.DBusService = old.Utcloud.DBusService
+	cfg.Utcloud.DBusPath = old.Utcloud.DBusPath
+	cfg.Utcloud.DBusIface = old.Utcloud.DBusIface
+	cfg.Jobs = old.Jobs
+	cfg.Token.Store = old.Token.Store
+	cfg.Token.File = old.Token.File
+	cfg.Sync.Watch = old.Sync.Watch
+	cfg.Network.ProbeInterval = old.Network.ProbeInterval
+}
@@ -2,8 +2,13 @@ package service
 
 import (
 	"flag"
+	"github.com/jibenliu/utMsgDaemon/utils"
 	"github.com/kardianos/service"
 	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 )
 
@@ -17,20 +22,29 @@ func (p *program) Start(s service.Service) error {
 	} else {
 		log.Info("Running under service manager.")
 	}
-	go p.run()
 	p.exit = make(chan struct{})
+	go p.run()
 	return nil
 }
 func (p *program) run() {
 	log.Infof("I'm running %v.", service.Platform())
 	initDbusService()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	ticker := time.NewTicker(2 * time.Second)
 	for {
 		select {
 		case tm := <-ticker.C:
-			log.Infof("Still running at %v...", tm)
+			bus := utils.GetBus(utils.Conf().Service.Bus)
+			log.Infof("Still running at %v, bus %s, reconnects %d...", tm, bus.State(), bus.Reconnects())
+		case <-hup:
+			log.Info("receive SIGHUP, reload config")
+			_, _ = reloadConfig()
 		case <-p.exit:
+			signal.Stop(hup)
 			ticker.Stop()
+			jobs.Stop()
+			utils.CloseBus()
 			return
 		}
 	}
@@ -50,10 +64,25 @@ func (p *program) Stop(s service.Service) error {
 //   Run the service.
 func DaemonSetup() {
 	svcFlag := flag.String("service", "", "Control the system service.")
+	confFlag := flag.String("config", "", "Path of the daemon config file.")
 	flag.Parse()
+	if len(*confFlag) != 0 {
+		confPath, err := filepath.Abs(*confFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		configFile = confPath
+	}
+	cfg, err := utils.LoadConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	utils.SetConf(cfg)
+	applyLogLevel(cfg)
 	options := make(service.KeyValue)
 	options["Restart"] = "on-success"
 	options["SuccessExitStatus"] = "1 2 8 SIGKILL"
+	options["ReloadSignal"] = "HUP"
 	svcConfig := &service.Config{
 		Name:        "utMsgDaemon",
 		DisplayName: "utcloud Service Test Daemon",
@@ -63,6 +92,9 @@ func DaemonSetup() {
 			"After=dbus.service"},
 		Option: options,
 	}
+	if len(configFile) != 0 {
+		svcConfig.Arguments = []string{"-config", configFile}
+	}
 	prg := &program{}
 	s, err := service.New(prg, svcConfig)
 	if err != nil {
@@ -74,6 +106,14 @@ func DaemonSetup() {
 			log.Printf("Valid actions: %q\n", service.ControlAction)
 			log.Fatal(err)
 		}
+		switch *svcFlag {
+		case "install":
+			if err := installDBusFiles(svcConfig.Name, svcConfig.Arguments); err != nil {
+				log.Fatalf("install dbus files fail:%v", err)
+			}
+		case "uninstall":
+			removeDBusFiles()
+		}
 		return
 	}
 	err = s.Run()
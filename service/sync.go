@@ -0,0 +1,294 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jibenliu/utMsgDaemon/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+var errSyncNotFound = &utils.Error{Kind: utils.KindNotFound, Code: -1, Message: "sync not found"}
+
+// SyncFolder 已注册的同步目录
+type SyncFolder struct {
+	ID        string `json:"id"`
+	Dir       string `json:"dir"`
+	Prefix    string `json:"prefix"`
+	Mode      string `json:"mode"`      //upload或twoway
+	LastSync  int64  `json:"last_sync"` //上次同步完成的时间
+	LastError string `json:"last_error"`
+	UID       uint32 `json:"uid"` //注册同步目录的用户，同步任务属于该用户
+}
+
+//syncRegistry 同步目录列表，持久化到状态目录
+type syncRegistry struct {
+	mut      sync.Mutex
+	file     string
+	folders  []SyncFolder
+	watchers map[string]*utils.DirWatcher //key为同步目录ID
+}
+
+var syncs = &syncRegistry{watchers: map[string]*utils.DirWatcher{}}
+
+//
+// initSyncs
+//  @Description: 加载已注册的同步目录并注册同步任务处理函数，导出服务后再调用startSyncs开始监听
+//  @param cfg
+//  @return error
+//
+func initSyncs(cfg *utils.Config) error {
+	syncs.file = cfg.StatePath("syncs.json")
+	data, err := ioutil.ReadFile(syncs.file)
+	if err == nil {
+		err = json.Unmarshal(data, &syncs.folders)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := range syncs.folders {
+		if len(syncs.folders[i].Mode) == 0 {
+			syncs.folders[i].Mode = utils.SyncUpload
+		}
+		// 旧版本没有记录用户，按目录属主处理
+		if syncs.folders[i].UID == 0 {
+			if uid, err := utils.FileOwner(syncs.folders[i].Dir); err == nil {
+				syncs.folders[i].UID = uid
+			}
+		}
+	}
+	jobs.Handle(utils.JobSync, syncJob)
+	return nil
+}
+
+// startSyncs 开启sync.watch时监听所有目录，并同步一次守护进程未运行期间的变化；
+// 提交任务会更新Jobs属性，需要在svc初始化并启动任务队列之后调用
+func startSyncs() {
+	if !utils.Conf().Sync.Watch {
+		return
+	}
+	for _, folder := range syncs.list() {
+		syncs.watch(folder)
+		autoSync(folder.ID)
+	}
+}
+
+// add 注册uid用户的同步目录，目录、前缀和模式都相同时返回已有的记录
+func (r *syncRegistry) add(dir, prefix, mode string, uid uint32) (SyncFolder, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	for _, f := range r.folders {
+		if f.Dir == dir && f.Prefix == prefix {
+			if f.Mode != mode {
+				return f, &utils.Error{Kind: utils.KindConflict, Code: -1, Message: "sync already exists with another mode"}
+			}
+			return f, nil
+		}
+	}
+	folder := SyncFolder{ID: utils.NewID(), Dir: dir, Prefix: prefix, Mode: mode, UID: uid}
+	r.folders = append(r.folders, folder)
+	if err := r.save(); err != nil {
+		return folder, err
+	}
+	if utils.Conf().Sync.Watch {
+		r.watchLocked(folder)
+		go autoSync(folder.ID)
+	}
+	return folder, nil
+}
+
+// remove 取消同步目录，云端已同步的文件保留
+func (r *syncRegistry) remove(id string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	for i, f := range r.folders {
+		if f.ID == id {
+			r.folders = append(r.folders[:i], r.folders[i+1:]...)
+			if w, has := r.watchers[id]; has {
+				w.Close()
+				delete(r.watchers, id)
+			}
+			_ = os.Remove(manifestPath(id))
+			return r.save()
+		}
+	}
+	return errSyncNotFound
+}
+
+// watch 监听同步目录，目录变化时自动同步
+func (r *syncRegistry) watch(folder SyncFolder) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.watchLocked(folder)
+}
+
+func (r *syncRegistry) watchLocked(folder SyncFolder) {
+	if _, has := r.watchers[folder.ID]; has {
+		return
+	}
+	w := utils.NewDirWatcher(folder.Dir, func() {
+		autoSync(folder.ID)
+	})
+	w.Start()
+	r.watchers[folder.ID] = w
+}
+
+func (r *syncRegistry) get(id string) (SyncFolder, bool) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	for _, f := range r.folders {
+		if f.ID == id {
+			return f, true
+		}
+	}
+	return SyncFolder{}, false
+}
+
+func (r *syncRegistry) list() []SyncFolder {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return append([]SyncFolder{}, r.folders...)
+}
+
+// finish 记录同步结果
+func (r *syncRegistry) finish(id string, err error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	for i := range r.folders {
+		if r.folders[i].ID == id {
+			r.folders[i].LastSync = time.Now().Unix()
+			r.folders[i].LastError = ""
+			if err != nil {
+				r.folders[i].LastError = err.Error()
+			}
+			if err := r.save(); err != nil {
+				log.Errorf("save syncs error:[%s]", err.Error())
+			}
+			return
+		}
+	}
+}
+
+func (r *syncRegistry) save() error {
+	data, err := json.Marshal(r.folders)
+	if err != nil {
+		return err
+	}
+	if err := utils.MakeDir(filepath.Dir(r.file)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.file, data, 0600)
+}
+
+//manifestPath 同步目录的清单文件
+func manifestPath(id string) string {
+	return utils.Conf().StatePath("sync/" + id + ".json")
+}
+
+// addSync 校验并注册同步目录，只允许同步调用方自己的目录
+func addSync(caller *utils.Caller, dir, prefix, mode string) (string, error) {
+	prefix = strings.Trim(prefix, "/")
+	if len(dir) == 0 || len(prefix) == 0 || !filepath.IsAbs(dir) {
+		return "", utils.ErrInvalidParam
+	}
+	if mode != utils.SyncUpload && mode != utils.SyncTwoWay {
+		return "", &utils.Error{Kind: utils.KindInvalidArgument, Code: -1, Message: fmt.Sprintf("invalid sync mode %q", mode)}
+	}
+	dir = filepath.Clean(dir)
+	if info, err := os.Stat(dir); err != nil {
+		return "", err
+	} else if !info.IsDir() {
+		return "", &utils.Error{Kind: utils.KindInvalidArgument, Code: -1, Message: fmt.Sprintf("%s is not a directory", dir)}
+	}
+	if err := utils.CheckFileOwner(dir, caller.UID); err != nil {
+		return "", err
+	}
+	// 不能同步到其他用户的prefix
+	if err := checkPrefix(caller.UID, prefix); err != nil {
+		return "", err
+	}
+	folder, err := syncs.add(dir, prefix, mode, caller.UID)
+	if err != nil {
+		return "", err
+	}
+	log.WithFields(log.Fields{
+		"path":   caller.Exe,
+		"method": "AddSync",
+	}).Infof("同步目录%s到%s，模式%s", dir, prefix, mode)
+	return folder.ID, nil
+}
+
+// submitSync 提交同步任务，该目录已有未结束的同步任务时直接返回该任务
+func submitSync(folder SyncFolder) (utils.Job, error) {
+	for _, job := range jobs.List() {
+		if job.Kind == utils.JobSync && job.Key == folder.ID && !job.Finished() {
+			return job, nil
+		}
+	}
+	return jobs.Submit(utils.JobSync, folder.ID, folder.Dir, folder.UID)
+}
+
+// ownSync 获取调用方注册的同步目录，root可以访问所有同步目录，其他用户的同步目录按不存在处理
+func ownSync(caller *utils.Caller, id string) (SyncFolder, error) {
+	folder, has := syncs.get(id)
+	if !has || (caller.UID != 0 && folder.UID != caller.UID) {
+		return SyncFolder{}, errSyncNotFound
+	}
+	return folder, nil
+}
+
+// autoSync 目录变化时提交同步任务，没有token时跳过，设置token后下次变化或扫描时再同步
+func autoSync(id string) {
+	folder, has := syncs.get(id)
+	if !has {
+		return
+	}
+	if len(tokens.Get()) == 0 {
+		log.Debugf("sync %s skipped, token not found", folder.Dir)
+		return
+	}
+	if _, err := submitSync(folder); err != nil {
+		log.Errorf("submit sync %s error:[%s]", folder.Dir, err.Error())
+	}
+}
+
+// syncJob 按同步模式同步目录，返回同步结果统计；有文件因时段限制未上传时，到时段结束后再同步一次
+func syncJob(ctx context.Context, job *utils.Job, progress utils.ProgressFunc) (string, error) {
+	folder, has := syncs.get(job.Key)
+	if !has {
+		return "", errSyncNotFound
+	}
+	token := tokens.Get()
+	if len(token) == 0 {
+		return "", utils.ErrNoToken
+	}
+	log.Debugf("sync job %s start, dir:[%s] prefix:[%s]", job.ID, folder.Dir, folder.Prefix)
+	var stats utils.SyncStats
+	var err error
+	if folder.Mode == utils.SyncTwoWay {
+		stats, err = utils.SyncDirTwoWay(ctx, token, folder.Dir, folder.Prefix, manifestPath(folder.ID), func(rel, conflictFile string) {
+			emitSignalToUser(folder.UID, "SyncConflict", folder.ID, filepath.Join(folder.Dir, rel), conflictFile)
+		}, progress)
+	} else {
+		stats, err = utils.SyncDir(ctx, token, folder.Dir, folder.Prefix, manifestPath(folder.ID), progress)
+	}
+	if ctx.Err() == nil {
+		syncs.finish(folder.ID, err)
+	}
+	if stats.Deferred != 0 && ctx.Err() == nil {
+		time.AfterFunc(time.Until(stats.DeferredUntil), func() {
+			autoSync(folder.ID)
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+	return stats.String(), nil
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jibenliu/utMsgDaemon/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const tokenRetryDelay = 30 * time.Second
+
+//storedToken 持久化到TokenStore的内容
+type storedToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+//tokenHolder 云服务token，内存中缓存一份，持久化到TokenStore，过期前自动刷新
+type tokenHolder struct {
+	mut       sync.Mutex
+	store     utils.TokenStore
+	token     string
+	expiresAt time.Time //零值表示不过期
+	timer     *time.Timer
+	onChange  func(hasToken bool)
+}
+
+var tokens = &tokenHolder{}
+
+//
+// init
+//  @Description: 创建token存储并加载上次保存的token，已过期的token直接丢弃
+//  @param cfg
+//  @return error
+//
+func (t *tokenHolder) init(cfg *utils.Config) error {
+	store, err := utils.NewTokenStore(cfg)
+	if err != nil {
+		return err
+	}
+	data, err := store.Load()
+	if err != nil {
+		log.Errorf("load token error:[%s]", err.Error())
+	}
+	st := storedToken{}
+	if len(data) != 0 && json.Unmarshal([]byte(data), &st) != nil {
+		// 兼容直接保存token的旧格式
+		st = storedToken{Token: data, ExpiresAt: utils.TokenExpiry(data)}
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.store = store
+	if len(st.Token) != 0 && !st.ExpiresAt.IsZero() && time.Now().After(st.ExpiresAt) {
+		log.Warn("saved token expired")
+		_ = store.Clear()
+		return nil
+	}
+	t.token = st.Token
+	t.expiresAt = st.ExpiresAt
+	t.schedule()
+	return nil
+}
+
+// Get 获取当前token
+func (t *tokenHolder) Get() string {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.token
+}
+
+// ExpiresAt 获取token过期时间，零值表示不过期
+func (t *tokenHolder) ExpiresAt() time.Time {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.expiresAt
+}
+
+//
+// Set
+//  @Description: 保存token，为空时清除已保存的token
+//  @param token
+//  @param expiresAt 过期时间，零值时尝试从JWT中解析
+//  @return error
+//
+func (t *tokenHolder) Set(token string, expiresAt time.Time) error {
+	if expiresAt.IsZero() {
+		expiresAt = utils.TokenExpiry(token)
+	}
+	t.mut.Lock()
+	err := t.save(token, expiresAt)
+	onChange := t.onChange
+	t.mut.Unlock()
+	if err == nil && onChange != nil {
+		onChange(len(token) != 0)
+	}
+	return err
+}
+
+//save 持久化token并重新安排刷新，调用方需持有锁
+func (t *tokenHolder) save(token string, expiresAt time.Time) error {
+	var err error
+	if len(token) == 0 {
+		err = t.store.Clear()
+	} else {
+		data, _ := json.Marshal(storedToken{Token: token, ExpiresAt: expiresAt})
+		err = t.store.Save(string(data))
+	}
+	if err != nil {
+		log.Errorf("save token error:[%s]", err.Error())
+		return err
+	}
+	t.token = token
+	t.expiresAt = expiresAt
+	t.schedule()
+	return nil
+}
+
+//schedule 在过期前refresh_before刷新token，调用方需持有锁
+func (t *tokenHolder) schedule() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	if len(t.token) == 0 || t.expiresAt.IsZero() {
+		return
+	}
+	// 刷新得到的token仍在refresh_before之内时避免频繁刷新
+	delay := time.Until(t.expiresAt) - utils.Conf().Token.RefreshBefore
+	if delay < tokenRetryDelay {
+		delay = tokenRetryDelay
+		if until := time.Until(t.expiresAt); until < delay {
+			delay = until
+		}
+	}
+	t.timer = time.AfterFunc(delay, t.refresh)
+}
+
+//
+// refresh
+//  @Description: 通过utcloud daemon获取新token，失败时重试，到过期时间仍未成功则作废token
+//
+func (t *tokenHolder) refresh() {
+	token, err := utils.GetTokenByDaemon()
+	if exp := utils.TokenExpiry(token); err == nil && !exp.IsZero() && time.Now().After(exp) {
+		err = errors.New("refreshed token already expired")
+	}
+	if err == nil && len(token) != 0 {
+		log.Info("token refreshed")
+		_ = t.Set(token, time.Time{})
+		return
+	}
+	if err != nil {
+		log.Warnf("refresh token error:[%s]", err.Error())
+	}
+	t.mut.Lock()
+	if time.Now().Before(t.expiresAt) {
+		t.timer = time.AfterFunc(tokenRetryDelay, t.refresh)
+		t.mut.Unlock()
+		return
+	}
+	t.mut.Unlock()
+	log.Warn("token expired")
+	_ = t.Set("", time.Time{})
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/jibenliu/utMsgDaemon/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+//
+// transport
+//  @Description: 按utcloud.transport选择上传、删除文件的方式
+//  @return string 直接访问时使用的token
+//  @return bool 是否直接访问utcloud服务端及对象存储，否则通过utcloud daemon
+//  @return error direct模式下没有token时返回错误
+//
+func transport() (string, bool, error) {
+	token := tokens.Get()
+	switch utils.Conf().Utcloud.Transport {
+	case utils.TransportDaemon:
+		return "", false, nil
+	case utils.TransportDirect:
+		if len(token) == 0 {
+			return "", false, utils.ErrNoToken
+		}
+		return token, true, nil
+	}
+	if len(token) == 0 {
+		log.Debug("token not found, fallback to utcloud daemon")
+		return "", false, nil
+	}
+	return token, true, nil
+}
+
+// uploadFile 上传文件，直接访问时通过progress上报进度
+func uploadFile(ctx context.Context, key string, progress utils.ProgressFunc) (string, error) {
+	token, direct, err := transport()
+	if err != nil {
+		return "", err
+	}
+	if direct {
+		bts, err := utils.UploadUtDaemon(ctx, token, key, progress)
+		return string(bts), err
+	}
+	bts, err := utils.UploadByDaemon(ctx, key)
+	return string(bts), err
+}
+
+// deleteFile 删除云端文件，成功后删除key的上传用户记录
+func deleteFile(key string) (string, error) {
+	token, direct, err := transport()
+	if err != nil {
+		return "", err
+	}
+	var str string
+	if direct {
+		var ok bool
+		ok, err = utils.DeleteDaemon(token, key)
+		str = strconv.FormatBool(ok)
+	} else {
+		str, err = utils.DeleteByDaemon(key)
+	}
+	if err == nil {
+		keyOwners.remove(key)
+	}
+	return str, err
+}
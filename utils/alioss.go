@@ -1,21 +1,25 @@
 package utils
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	log "github.com/sirupsen/logrus"
-	"net/http"
+	"io"
+	"os"
 	"strings"
 
 	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 )
 
+var ErrMD5Mismatch = errors.New("md5 mismatch")
+
 func GetBucket(aliyunSign string) (*oss.Bucket, error) {
 	client, err := oss.New(aliyunSign, "", "")
 	if err != nil {
 		log.Errorf("oss create empty client error:[%s]", err.Error())
-		return nil, errors.New("oss opt error")
+		return nil, NewKindError(KindInvalidArgument, -1, err)
 	}
 
 	client.Config.IsEnableCRC = false //取消crc32校验
@@ -27,50 +31,54 @@ func GetBucket(aliyunSign string) (*oss.Bucket, error) {
 //
 // GetObject
 //  @Description: 下载数据:
+//  @param ctx 取消时中断下载
 //  @param bucket
 //  @param signUrl
 //  @param localFile
+//  @param md5sum 文件md5，不为空时校验通过后才写入localFile
+//  @param progress 下载进度回调，可为nil
 //  @return error
 //
-func GetObject(bucket *oss.Bucket, signUrl, localFile string) error {
+func GetObject(ctx context.Context, bucket *oss.Bucket, signUrl, localFile, md5sum string, progress ProgressFunc) error {
 	if bucket == nil {
-		return errors.New("param invalid")
+		return ErrInvalidParam
 	}
 
-	if err := CheckWriteFile(localFile); err != nil {
+	if err := CheckWriteFile(ctx, localFile); err != nil {
 		log.Errorf("check local path:[%s] error", localFile)
 		return err
 	}
 
-	err := bucket.GetObjectToFileWithURL(signUrl, localFile)
+	err := getObjectToFile(ctx, ossRangeGetter(bucket, signUrl), localFile, md5sum, progress)
 	if err != nil {
-		serr, ok := err.(oss.ServiceError)
-		if !ok {
-			log.Errorf("get object error:[%s]", err.Error())
-			if strings.Contains(err.Error(), "no such file or directory") {
-				return errors.New("no such file or directory")
-			}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == ErrMD5Mismatch {
 			return err
 		}
-		if serr.StatusCode == http.StatusNotFound {
-			err = errors.New("record not exist")
+		log.Errorf("get object error:[%s]", err.Error())
+		if strings.Contains(err.Error(), "no such file or directory") {
+			return ErrNoFile
 		}
 	}
-	return err
+	return ossMapError(err)
 }
 
 //
 // PutObject
 //  @Description: 上传数据:
+//  @param ctx 取消时中断上传
 //  @param bucket
 //  @param signUrl
 //  @param localFile
 //  @param md5sum
+//  @param progress 上传进度回调，可为nil
 //  @return error
 //
-func PutObject(bucket *oss.Bucket, signUrl, localFile, md5sum string) error {
+func PutObject(ctx context.Context, bucket *oss.Bucket, signUrl, localFile, md5sum string, progress ProgressFunc) error {
 	if bucket == nil {
-		return errors.New("param invalid")
+		return ErrInvalidParam
 	}
 
 	bmd5, _ := hex.DecodeString(md5sum)
@@ -80,16 +88,19 @@ func PutObject(bucket *oss.Bucket, signUrl, localFile, md5sum string) error {
 	// opts := oss.AddContentType(nil, localFile)
 	// opts = append(opts, oss.ContentMD5(base64.StdEncoding.EncodeToString(bmd5)))
 
-	err := bucket.PutObjectFromFileWithURL(signUrl, localFile, opts...)
+	err := putObjectFromFile(ctx, bucket, signUrl, localFile, progress, opts...)
 	if err == nil {
 		return err
 	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 
 	log.Errorf("alioss put object error:[%s]", err.Error())
 	if strings.Contains(err.Error(), "no such file or directory") {
-		return errors.New("no such file or directory")
+		return ErrNoFile
 	}
-	return errors.New("oss opt error")
+	return ossMapError(err)
 }
 
 //
@@ -104,9 +115,66 @@ func DeleteObjects(bucket *oss.Bucket, paths []string) ([]string, error) {
 	// 返回删除成功的文件。
 	delRes, err := bucket.DeleteObjects(paths)
 	if err != nil {
-		if err.(oss.ServiceError).StatusCode == http.StatusNotFound {
-			err = errors.New("record not exist")
+		return nil, ossMapError(err)
+	}
+	return delRes.DeletedObjects, nil
+}
+
+//----------------------辅助函数------------------------
+
+//putObjectFromFile 上传本地文件，oss sdk不支持context，通过transferReader中断上传
+func putObjectFromFile(ctx context.Context, bucket *oss.Bucket, signUrl, localFile string, progress ProgressFunc, opts ...oss.Option) error {
+	fd, err := openFile(ctx, localFile, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	reader := newTransferReader(ctx, TransferUpload, fd, info.Size(), progress)
+	// sdk通过LimitedReader获取Content-Length
+	return bucket.PutObjectWithURL(signUrl, &io.LimitedReader{R: reader, N: info.Size()}, opts...)
+}
+
+//transferReader 每次读取前检查context，读取后按全局及任务限速等待，并上报传输进度
+type transferReader struct {
+	ctx       context.Context
+	direction string //TransferUpload或TransferDownload
+	reader    io.Reader
+	done      int64
+	total     int64
+	progress  ProgressFunc
+}
+
+func newTransferReader(ctx context.Context, direction string, reader io.Reader, total int64, progress ProgressFunc) *transferReader {
+	if progress != nil {
+		progress(0, total)
+	}
+	return &transferReader{ctx: ctx, direction: direction, reader: reader, total: total, progress: progress}
+}
+
+func (t *transferReader) Read(p []byte) (int, error) {
+	if err := t.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) > limiterBurst {
+		p = p[:limiterBurst]
+	}
+	n, err := t.reader.Read(p)
+	if n > 0 {
+		if werr := waitBandwidth(t.ctx, t.direction, n); werr != nil {
+			return n, werr
+		}
+		t.done += int64(n)
+		if t.progress != nil {
+			t.progress(t.done, t.total)
 		}
 	}
-	return delRes.DeletedObjects, err
+	if err != nil && t.ctx.Err() != nil {
+		// 读取被中断时返回取消原因
+		err = t.ctx.Err()
+	}
+	return n, err
 }
@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	TransferUpload   = "upload"
+	TransferDownload = "download"
+
+	limiterBurst = 32 * 1024 //令牌桶容量，也是限速时单次读取的最大字节数
+)
+
+//DeferredError 任务暂时不能执行，由任务队列在Until之后重新排队
+type DeferredError struct {
+	Until time.Time
+}
+
+func (e *DeferredError) Error() string {
+	return fmt.Sprintf("deferred until %s", e.Until.Format("2006-01-02 15:04:05"))
+}
+
+type jobBandwidthKey struct{}
+
+//bandwidthLimiter 全局限速器，限速值变化时(配置重载、进入或离开时段、SetBandwidthLimit)自动调整
+type bandwidthLimiter struct {
+	mut      sync.Mutex
+	limiters map[string]*rate.Limiter
+	override map[string]int64 //SetBandwidthLimit设置的限速，优先于配置
+}
+
+var bandwidth = &bandwidthLimiter{
+	limiters: map[string]*rate.Limiter{},
+	override: map[string]int64{},
+}
+
+//
+// SetBandwidthLimit
+//  @Description: 运行时设置全局限速，优先于bandwidth配置及时段，重启后恢复为配置
+//  @param upload 上传限速(字节/秒)，0不限速，小于0时恢复使用配置
+//  @param download 下载限速(字节/秒)，0不限速，小于0时恢复使用配置
+//
+func SetBandwidthLimit(upload, download int64) {
+	bandwidth.mut.Lock()
+	defer bandwidth.mut.Unlock()
+	for direction, limit := range map[string]int64{TransferUpload: upload, TransferDownload: download} {
+		if limit < 0 {
+			delete(bandwidth.override, direction)
+		} else {
+			bandwidth.override[direction] = limit
+		}
+	}
+}
+
+//
+// BandwidthLimit
+//  @Description: 获取当前生效的全局限速
+//  @param direction TransferUpload或TransferDownload
+//  @param now
+//  @return int64 字节/秒，0表示不限速
+//
+func BandwidthLimit(direction string, now time.Time) int64 {
+	bandwidth.mut.Lock()
+	limit, has := bandwidth.override[direction]
+	bandwidth.mut.Unlock()
+	if has {
+		return limit
+	}
+	cfg := Conf().Bandwidth
+	limits := map[string]int64{TransferUpload: cfg.Upload, TransferDownload: cfg.Download}
+	for _, item := range cfg.Schedules {
+		if _, active := scheduleEnd(item, now); active {
+			limits = map[string]int64{TransferUpload: item.Upload, TransferDownload: item.Download}
+			break
+		}
+	}
+	return limits[direction]
+}
+
+//
+// UploadDeferredUntil
+//  @Description: 按时段配置判断大小为size的文件现在能否上传
+//  @param size 文件大小
+//  @param now
+//  @return time.Time 不能上传时返回所在时段的结束时间
+//  @return bool 是否需要推迟
+//
+func UploadDeferredUntil(size int64, now time.Time) (time.Time, bool) {
+	for _, item := range Conf().Bandwidth.Schedules {
+		if item.MaxUploadSize <= 0 || size <= item.MaxUploadSize {
+			continue
+		}
+		if end, active := scheduleEnd(item, now); active {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// WithJobBandwidth 为任务创建单独的限速器，按bandwidth.job_upload、job_download限制单个任务的传输速度
+func WithJobBandwidth(ctx context.Context) context.Context {
+	cfg := Conf().Bandwidth
+	if cfg.JobUpload <= 0 && cfg.JobDownload <= 0 {
+		return ctx
+	}
+	limiters := map[string]*rate.Limiter{
+		TransferUpload:   rate.NewLimiter(rateLimit(cfg.JobUpload), limiterBurst),
+		TransferDownload: rate.NewLimiter(rateLimit(cfg.JobDownload), limiterBurst),
+	}
+	return context.WithValue(ctx, jobBandwidthKey{}, limiters)
+}
+
+//----------------------辅助函数------------------------
+
+//waitBandwidth 传输n字节(不超过limiterBurst)后等待全局及任务限速，ctx取消时返回错误
+func waitBandwidth(ctx context.Context, direction string, n int) error {
+	if err := bandwidth.limiter(direction).WaitN(ctx, n); err != nil {
+		return err
+	}
+	if limiters, ok := ctx.Value(jobBandwidthKey{}).(map[string]*rate.Limiter); ok {
+		return limiters[direction].WaitN(ctx, n)
+	}
+	return nil
+}
+
+//limiter 获取方向对应的全局限速器，并按当前生效的限速调整
+func (b *bandwidthLimiter) limiter(direction string) *rate.Limiter {
+	limit := rateLimit(BandwidthLimit(direction, time.Now()))
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	lim, has := b.limiters[direction]
+	if !has {
+		lim = rate.NewLimiter(limit, limiterBurst)
+		b.limiters[direction] = lim
+	} else if lim.Limit() != limit {
+		lim.SetLimit(limit)
+	}
+	return lim
+}
+
+func rateLimit(bytesPerSecond int64) rate.Limit {
+	if bytesPerSecond <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(bytesPerSecond)
+}
+
+//
+// scheduleEnd
+//  @Description: 判断now是否在时段内
+//  @param item
+//  @param now
+//  @return time.Time 在时段内时返回时段结束时间
+//  @return bool
+//
+func scheduleEnd(item BandwidthSchedule, now time.Time) (time.Time, bool) {
+	start, err := parseClock(item.Start)
+	if err != nil {
+		return time.Time{}, false
+	}
+	end, err := parseClock(item.End)
+	if err != nil {
+		return time.Time{}, false
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	current := now.Sub(midnight)
+	var active bool
+	switch {
+	case start < end:
+		active = current >= start && current < end
+	case start > end:
+		active = current >= start || current < end
+	default:
+		// 开始与结束相同表示全天
+		active = true
+	}
+	if !active {
+		return time.Time{}, false
+	}
+	until := midnight.Add(end)
+	if !until.After(now) {
+		until = midnight.AddDate(0, 0, 1).Add(end)
+	}
+	return until, true
+}
+
+//parseClock 解析HH:MM格式的时间，返回距零点的时长
+func parseClock(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, should be HH:MM", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -1,17 +1,10 @@
 package utils
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
-	log "github.com/sirupsen/logrus"
-	"io/ioutil"
+	"errors"
+	"github.com/jibenliu/utMsgDaemon/utils/utcloud"
 	"net/http"
-	"strings"
-)
-
-const (
-	TagCookie string = "token"
 )
 
 type _errSt struct {
@@ -24,56 +17,36 @@ func (e _errSt) Error() string {
 	return string(be)
 }
 
-// newError
-func newError(r int, m string) error {
-	return _errSt{Code: r, Msg: m}
-}
-
-// HTTPCall curl请求
-func HTTPCall(method, remoteURL string, head map[string]string, query, body map[string]interface{}) ([]byte, error) {
-	log.Debugf("http request method is:[%s], remoteURL is:[%s], head is:[%#v] query is:[%s] body is:[%#v]", method, remoteURL, head, query, body)
-	var err error = nil
-	var bd []byte
-	if body != nil {
-		bd, err = json.Marshal(body)
-		if err != nil {
-			return nil, err
-		}
+// ErrorCode 获取错误码，服务端返回的错误使用其状态码，其他错误返回-1
+func ErrorCode(err error) int32 {
+	if err == nil {
+		return 0
 	}
-	req, err := http.NewRequest(method, remoteURL, bytes.NewBuffer(bd))
-	if err != nil {
-		return nil, err
+	var ke *Error
+	if errors.As(err, &ke) {
+		return ke.Code
 	}
-
-	if query != nil {
-		q := req.URL.Query()
-		for k, v := range query {
-			q.Add(k, fmt.Sprint(v))
-		}
-		req.URL.RawQuery = q.Encode()
+	var e _errSt
+	if errors.As(err, &e) {
+		return int32(e.Code)
 	}
-	for k, v := range head {
-		if strings.EqualFold(k, TagCookie) {
-			req.AddCookie(&http.Cookie{Name: k, Value: v, HttpOnly: true})
+	var ue *utcloud.Error
+	if errors.As(err, &ue) {
+		if ue.StatusCode != http.StatusOK {
+			return int32(ue.StatusCode)
+		}
+		if ue.Code != 0 {
+			return int32(ue.Code)
 		}
-		req.Header.Set(k, v)
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Errorf("http request do error:[%s]", err.Error())
-		return nil, newError(resp.StatusCode, err.Error())
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, newError(resp.StatusCode, "response status code error")
-	}
-
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, newError(resp.StatusCode, err.Error())
 	}
+	return -1
+}
 
-	return data, nil
+// apiClient 按当前配置创建utcloud服务端接口客户端
+func apiClient(token string) *utcloud.Client {
+	cfg := Conf()
+	client := utcloud.NewClient(cfg.Utcloud.Server, token)
+	client.Timeout = cfg.Utcloud.Timeout
+	client.Retries = cfg.Utcloud.Retries
+	return client
 }
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//loadJSON 读取状态目录下的断点、清单等json文件，不存在或已损坏时返回false
+func loadJSON(file string, v interface{}) bool {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		log.Warnf("%s corrupted:[%s]", file, err.Error())
+		return false
+	}
+	return true
+}
+
+//saveJSON 原子写入状态目录下的json文件，中断时不会留下不完整的内容
+func saveJSON(file string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := MakeDir(filepath.Dir(file)); err != nil {
+		return err
+	}
+	return writeFileAtomic(file, data, 0600)
+}
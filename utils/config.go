@@ -0,0 +1,468 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	configName = "utMsgDaemon"
+	envPrefix  = "UTMSGDAEMON"
+)
+
+// Config 守护进程配置
+type Config struct {
+	StateDir  string          `mapstructure:"state_dir"` //状态目录，为空时system模式使用/var/lib/utMsgDaemon，session模式使用~/.local/state/utMsgDaemon
+	Service   ServiceConfig   `mapstructure:"service"`
+	Utcloud   UtcloudConfig   `mapstructure:"utcloud"`
+	App       AppConfig       `mapstructure:"app"`
+	Log       LogConfig       `mapstructure:"log"`
+	Auth      AuthConfig      `mapstructure:"auth"`
+	Token     TokenConfig     `mapstructure:"token"`
+	Jobs      JobsConfig      `mapstructure:"jobs"`
+	Transfer  TransferConfig  `mapstructure:"transfer"`
+	Storage   StorageConfig   `mapstructure:"storage"`
+	Sync      SyncConfig      `mapstructure:"sync"`
+	Network   NetworkConfig   `mapstructure:"network"`
+	Bandwidth BandwidthConfig `mapstructure:"bandwidth"`
+}
+
+// ServiceConfig 导出到dbus上的服务信息
+type ServiceConfig struct {
+	Bus       string `mapstructure:"bus"` //session或system，system模式下为本机所有用户提供服务
+	Name      string `mapstructure:"name"`
+	Path      string `mapstructure:"path"`
+	Interface string `mapstructure:"interface"`
+}
+
+// UtcloudConfig utcloud服务端及utcloud daemon信息
+type UtcloudConfig struct {
+	Server      string        `mapstructure:"server"`
+	Timeout     time.Duration `mapstructure:"timeout"`
+	Retries     int           `mapstructure:"retries"`  //请求失败后的最大重试次数，非幂等接口只在请求未发出时重试
+	DBusBus     string        `mapstructure:"dbus_bus"` //utcloud daemon所在总线
+	DBusService string        `mapstructure:"dbus_service"`
+	DBusPath    string        `mapstructure:"dbus_path"`
+	DBusIface   string        `mapstructure:"dbus_interface"` //utcloud daemon接口名，用于监听UserInfo属性变化
+	TokenMethod string        `mapstructure:"token_method"`   //获取token的utcloud daemon方法，为空时不自动刷新token
+	Transport   string        `mapstructure:"transport"`      //daemon、direct或auto，上传和删除文件的方式
+}
+
+// AppConfig 添加白名单时注册到utcloud的应用信息
+type AppConfig struct {
+	Name         string `mapstructure:"name"`
+	Description  string `mapstructure:"description"`
+	Developer    string `mapstructure:"developer"`
+	Email        string `mapstructure:"email"`
+	ShowSwitcher bool   `mapstructure:"show_switcher"`
+}
+
+// LogConfig 日志配置
+type LogConfig struct {
+	Level string `mapstructure:"level"`
+}
+
+// AuthConfig 调用方鉴权配置
+type AuthConfig struct {
+	Enabled bool                `mapstructure:"enabled"`
+	Polkit  bool                `mapstructure:"polkit"` //system总线模式下AddWhitelist、SetToken默认需要polkit授权
+	Rules   map[string]AuthRule `mapstructure:"rules"`  //key为方法名(不区分大小写)，未配置的方法使用default规则
+}
+
+// AuthRule 单个方法的鉴权规则，paths与uids都为空时不限制调用方
+type AuthRule struct {
+	Paths        []string `mapstructure:"paths"`         //允许的可执行文件路径，支持通配符
+	UIDs         []uint32 `mapstructure:"uids"`          //允许的用户ID
+	PolkitAction string   `mapstructure:"polkit_action"` //非空时还需要通过polkit授权
+}
+
+// TokenConfig 云服务token存储配置
+type TokenConfig struct {
+	Store         string        `mapstructure:"store"`          //auto、secret-service或file，auto在session总线上优先使用Secret Service
+	File          string        `mapstructure:"file"`           //file存储的文件路径，为空时使用状态目录下的token
+	RefreshBefore time.Duration `mapstructure:"refresh_before"` //token过期前多久开始刷新
+}
+
+// JobsConfig 后台任务配置
+type JobsConfig struct {
+	Workers int `mapstructure:"workers"` //并发执行的任务数
+	Keep    int `mapstructure:"keep"`    //任务日志中保留的已结束任务数
+}
+
+// TransferConfig 文件传输配置
+type TransferConfig struct {
+	PartSize           int64         `mapstructure:"part_size"`           //分片大小(字节)
+	Parallel           int           `mapstructure:"parallel"`            //同一文件并发传输的分片数
+	MultipartThreshold int64         `mapstructure:"multipart_threshold"` //不小于该大小的文件分片上传，0表示不分片
+	Timeout            time.Duration `mapstructure:"timeout"`             //对象存储请求连接、等待响应及传输中连续无数据的最长时间
+}
+
+// StorageConfig 对象存储配置
+type StorageConfig struct {
+	Driver    string `mapstructure:"driver"`     //oss、s3或local
+	LocalRoot string `mapstructure:"local_root"` //local存储的根目录，为空时使用状态目录下的storage
+}
+
+// SyncConfig 目录同步配置
+type SyncConfig struct {
+	Watch        bool          `mapstructure:"watch"`         //监听目录变化自动同步
+	Debounce     time.Duration `mapstructure:"debounce"`      //最后一次变化后等待多久开始同步
+	ScanInterval time.Duration `mapstructure:"scan_interval"` //无法监听目录(如超过inotify数量限制)时定期扫描的间隔
+	Ignore       []string      `mapstructure:"ignore"`        //不同步的文件或目录名，支持通配符
+}
+
+// NetworkConfig 网络状态检测配置
+type NetworkConfig struct {
+	ProbeInterval time.Duration `mapstructure:"probe_interval"` //探测utcloud服务端的间隔
+	ProbeTimeout  time.Duration `mapstructure:"probe_timeout"`  //单次探测的超时时间
+}
+
+// BandwidthConfig 传输限速配置，对oss、s3及local存储同样生效，通过utcloud daemon传输时不限速
+type BandwidthConfig struct {
+	Upload      int64               `mapstructure:"upload"`       //全局上传限速(字节/秒)，0不限速
+	Download    int64               `mapstructure:"download"`     //全局下载限速(字节/秒)，0不限速
+	JobUpload   int64               `mapstructure:"job_upload"`   //单个任务的上传限速(字节/秒)，0不限速
+	JobDownload int64               `mapstructure:"job_download"` //单个任务的下载限速(字节/秒)，0不限速
+	Schedules   []BandwidthSchedule `mapstructure:"schedules"`    //按时段替换全局限速，按顺序匹配第一个所在的时段
+}
+
+//BandwidthSchedule 按时段限速，start晚于end时表示跨零点的时段
+type BandwidthSchedule struct {
+	Start         string `mapstructure:"start"`           //开始时间，如22:00
+	End           string `mapstructure:"end"`             //结束时间，如07:30
+	Upload        int64  `mapstructure:"upload"`          //时段内的全局上传限速(字节/秒)，0不限速
+	Download      int64  `mapstructure:"download"`        //时段内的全局下载限速(字节/秒)，0不限速
+	MaxUploadSize int64  `mapstructure:"max_upload_size"` //时段内只上传不超过该大小(字节)的文件，更大的上传任务推迟到时段结束，0不限制
+}
+
+var defaults = map[string]interface{}{
+	"state_dir":                    "",
+	"service.bus":                  BusSession,
+	"service.name":                 "com.uniontech.msgExample",
+	"service.path":                 "/com/uniontech/msgExample",
+	"service.interface":            "com.uniontech.msgExample",
+	"utcloud.server":               "http://utcloud-pre.chinauos.com",
+	"utcloud.timeout":              30 * time.Second,
+	"utcloud.retries":              2,
+	"utcloud.dbus_bus":             BusSession,
+	"utcloud.dbus_service":         "com.deepin.utcloud.Daemon",
+	"utcloud.dbus_path":            "/com/deepin/utcloud/Daemon",
+	"utcloud.dbus_interface":       "com.deepin.utcloud.Daemon",
+	"utcloud.token_method":         "GetToken",
+	"utcloud.transport":            TransportAuto,
+	"app.name":                     "测试云服务对接app",
+	"app.description":              "测试用demo",
+	"app.developer":                "ut003500",
+	"app.email":                    "ut003500@uniontech.com",
+	"app.show_switcher":            false,
+	"log.level":                    "debug",
+	"auth.enabled":                 true,
+	"auth.polkit":                  true,
+	"auth.rules":                   map[string]interface{}{},
+	"token.store":                  TokenStoreAuto,
+	"token.file":                   "",
+	"token.refresh_before":         5 * time.Minute,
+	"jobs.workers":                 2,
+	"jobs.keep":                    100,
+	"transfer.part_size":           8 << 20,
+	"transfer.parallel":            3,
+	"transfer.multipart_threshold": 64 << 20,
+	"transfer.timeout":             time.Minute,
+	"storage.driver":               StorageOSS,
+	"storage.local_root":           "",
+	"sync.watch":                   true,
+	"sync.debounce":                3 * time.Second,
+	"sync.scan_interval":           5 * time.Minute,
+	"sync.ignore":                  []string{"*.tmp", "*.swp", "*~", ".#*", ".~lock.*#"},
+	"network.probe_interval":       30 * time.Second,
+	"network.probe_timeout":        5 * time.Second,
+	"bandwidth.upload":             0,
+	"bandwidth.download":           0,
+	"bandwidth.job_upload":         0,
+	"bandwidth.job_download":       0,
+	"bandwidth.schedules":          []interface{}{},
+}
+
+var (
+	confLock sync.RWMutex
+	conf     = DefaultConfig()
+)
+
+// Conf 获取当前生效的配置，返回值只读，不要修改
+func Conf() *Config {
+	confLock.RLock()
+	defer confLock.RUnlock()
+	return conf
+}
+
+// SetConf 替换当前生效的配置
+func SetConf(c *Config) {
+	confLock.Lock()
+	defer confLock.Unlock()
+	conf = c
+}
+
+// DefaultConfig 获取默认配置，不读取环境变量，环境变量在LoadConfig中解析
+func DefaultConfig() *Config {
+	c, err := decodeConfig(newViper())
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+//
+// LoadConfig
+//  @Description: 加载配置文件，优先级：环境变量 > 配置文件 > 默认值
+//  @param file 配置文件路径，为空时依次查找/etc/utMsgDaemon、~/.config/utMsgDaemon及当前目录，找不到则使用默认值
+//  @return *Config
+//  @return error
+//
+func LoadConfig(file string) (*Config, error) {
+	v := newViper()
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	if len(file) != 0 {
+		v.SetConfigFile(file)
+	} else {
+		v.SetConfigName(configName)
+		v.AddConfigPath("/etc/utMsgDaemon/")
+		v.AddConfigPath("$HOME/.config/utMsgDaemon/")
+		v.AddConfigPath(".")
+	}
+	err := v.ReadInConfig()
+	if err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return nil, fmt.Errorf("read config error: %v", err)
+		}
+		log.Warn("config file not found, use default config")
+	} else {
+		log.Infof("load config from %s", v.ConfigFileUsed())
+	}
+
+	c, err := decodeConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate 校验配置是否合法
+func (c *Config) Validate() error {
+	if !validBusType(c.Service.Bus) {
+		return fmt.Errorf("invalid service.bus: %q", c.Service.Bus)
+	}
+	if !validBusName(c.Service.Name) {
+		return fmt.Errorf("invalid service.name: %q", c.Service.Name)
+	}
+	if !validObjectPath(c.Service.Path) {
+		return fmt.Errorf("invalid service.path: %q", c.Service.Path)
+	}
+	if !validBusName(c.Service.Interface) {
+		return fmt.Errorf("invalid service.interface: %q", c.Service.Interface)
+	}
+	u, err := url.Parse(c.Utcloud.Server)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("invalid utcloud.server: %q", c.Utcloud.Server)
+	}
+	if c.Utcloud.Timeout <= 0 {
+		return errors.New("utcloud.timeout should be positive")
+	}
+	if c.Utcloud.Retries < 0 {
+		return errors.New("utcloud.retries should not be negative")
+	}
+	if !validBusType(c.Utcloud.DBusBus) {
+		return fmt.Errorf("invalid utcloud.dbus_bus: %q", c.Utcloud.DBusBus)
+	}
+	if !validBusName(c.Utcloud.DBusService) {
+		return fmt.Errorf("invalid utcloud.dbus_service: %q", c.Utcloud.DBusService)
+	}
+	if !validObjectPath(c.Utcloud.DBusPath) {
+		return fmt.Errorf("invalid utcloud.dbus_path: %q", c.Utcloud.DBusPath)
+	}
+	if !validBusName(c.Utcloud.DBusIface) {
+		return fmt.Errorf("invalid utcloud.dbus_interface: %q", c.Utcloud.DBusIface)
+	}
+	switch c.Utcloud.Transport {
+	case TransportDaemon, TransportDirect, TransportAuto:
+	default:
+		return fmt.Errorf("invalid utcloud.transport: %q", c.Utcloud.Transport)
+	}
+	if len(c.App.Name) == 0 {
+		return errors.New("app.name should not be empty")
+	}
+	if _, err := log.ParseLevel(c.Log.Level); err != nil {
+		return fmt.Errorf("invalid log.level: %v", err)
+	}
+	switch c.Token.Store {
+	case TokenStoreAuto, TokenStoreSecret, TokenStoreFile:
+	default:
+		return fmt.Errorf("invalid token.store: %q", c.Token.Store)
+	}
+	if c.Token.RefreshBefore < 0 {
+		return errors.New("token.refresh_before should not be negative")
+	}
+	if c.Jobs.Workers <= 0 {
+		return errors.New("jobs.workers should be positive")
+	}
+	if c.Jobs.Keep < 0 {
+		return errors.New("jobs.keep should not be negative")
+	}
+	if c.Transfer.PartSize < minPartSize || c.Transfer.PartSize > maxPartSize {
+		return fmt.Errorf("transfer.part_size should be between %d and %d", minPartSize, maxPartSize)
+	}
+	if c.Transfer.Parallel <= 0 {
+		return errors.New("transfer.parallel should be positive")
+	}
+	if c.Transfer.MultipartThreshold < 0 {
+		return errors.New("transfer.multipart_threshold should not be negative")
+	}
+	if c.Transfer.Timeout <= 0 {
+		return errors.New("transfer.timeout should be positive")
+	}
+	switch c.Storage.Driver {
+	case StorageOSS, StorageS3, StorageLocal:
+	default:
+		return fmt.Errorf("invalid storage.driver: %q", c.Storage.Driver)
+	}
+	if len(c.Storage.LocalRoot) != 0 && !filepath.IsAbs(c.Storage.LocalRoot) {
+		return fmt.Errorf("storage.local_root should be absolute: %q", c.Storage.LocalRoot)
+	}
+	if c.Sync.Debounce <= 0 {
+		return errors.New("sync.debounce should be positive")
+	}
+	if c.Sync.ScanInterval <= 0 {
+		return errors.New("sync.scan_interval should be positive")
+	}
+	for _, item := range c.Sync.Ignore {
+		if _, err := filepath.Match(item, ""); err != nil {
+			return fmt.Errorf("invalid sync.ignore: %q", item)
+		}
+	}
+	if c.Network.ProbeInterval <= 0 {
+		return errors.New("network.probe_interval should be positive")
+	}
+	if c.Network.ProbeTimeout <= 0 {
+		return errors.New("network.probe_timeout should be positive")
+	}
+	if c.Bandwidth.Upload < 0 || c.Bandwidth.Download < 0 || c.Bandwidth.JobUpload < 0 || c.Bandwidth.JobDownload < 0 {
+		return errors.New("bandwidth limits should not be negative")
+	}
+	for i, item := range c.Bandwidth.Schedules {
+		if _, err := parseClock(item.Start); err != nil {
+			return fmt.Errorf("bandwidth.schedules[%d].start: %s", i, err.Error())
+		}
+		if _, err := parseClock(item.End); err != nil {
+			return fmt.Errorf("bandwidth.schedules[%d].end: %s", i, err.Error())
+		}
+		if item.Upload < 0 || item.Download < 0 || item.MaxUploadSize < 0 {
+			return fmt.Errorf("bandwidth.schedules[%d] limits should not be negative", i)
+		}
+	}
+	for method, rule := range c.Auth.Rules {
+		for _, item := range rule.Paths {
+			if _, err := filepath.Match(item, ""); err != nil || !filepath.IsAbs(item) {
+				return fmt.Errorf("invalid auth.rules.%s.paths: %q", method, item)
+			}
+		}
+	}
+	return nil
+}
+
+// StatePath 获取状态目录下的文件路径
+func (c *Config) StatePath(name string) string {
+	dir := c.StateDir
+	if len(dir) == 0 {
+		if c.Service.Bus == BusSystem {
+			dir = "/var/lib/utMsgDaemon"
+		} else if xdg := os.Getenv("XDG_STATE_HOME"); len(xdg) != 0 {
+			dir = filepath.Join(xdg, "utMsgDaemon")
+		} else {
+			home, _ := os.UserHomeDir()
+			dir = filepath.Join(home, ".local", "state", "utMsgDaemon")
+		}
+	}
+	return filepath.Join(dir, name)
+}
+
+// ServerURL 拼接utcloud服务端接口地址
+func (c *Config) ServerURL(api string) string {
+	return strings.TrimRight(c.Utcloud.Server, "/") + api
+}
+
+//----------------------辅助函数------------------------
+
+//newViper 创建只包含默认值的viper
+func newViper() *viper.Viper {
+	v := viper.New()
+	for key, value := range defaults {
+		v.SetDefault(key, value)
+	}
+	return v
+}
+
+func decodeConfig(v *viper.Viper) (*Config, error) {
+	c := &Config{}
+	if err := v.Unmarshal(c); err != nil {
+		return nil, fmt.Errorf("decode config error: %v", err)
+	}
+	return c, nil
+}
+
+func validBusType(kind string) bool {
+	return kind == BusSession || kind == BusSystem
+}
+
+func validBusName(name string) bool {
+	if len(name) == 0 || len(name) > 255 {
+		return false
+	}
+	elements := strings.Split(name, ".")
+	if len(elements) < 2 {
+		return false
+	}
+	for _, item := range elements {
+		if len(item) == 0 || (item[0] >= '0' && item[0] <= '9') {
+			return false
+		}
+		for _, c := range item {
+			if !(c == '_' || c == '-' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func validObjectPath(path string) bool {
+	if len(path) == 0 || path[0] != '/' {
+		return false
+	}
+	if path == "/" {
+		return true
+	}
+	for _, item := range strings.Split(path[1:], "/") {
+		if len(item) == 0 {
+			return false
+		}
+		for _, c := range item {
+			if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,220 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// BusState 总线连接状态
+type BusState int32
+
+const (
+	BusDisconnected BusState = iota //未连接
+	BusConnecting                   //正在连接(重连)
+	BusConnected                    //已连接
+)
+
+func (s BusState) String() string {
+	switch s {
+	case BusConnecting:
+		return "connecting"
+	case BusConnected:
+		return "connected"
+	}
+	return "disconnected"
+}
+
+// OnConnectFunc 连接建立(包括重连)后执行，用于申请服务名、导出对象及订阅信号
+type OnConnectFunc func(conn *dbus.Conn) error
+
+//BusManager 管理一条总线连接，断开后自动重连并重新执行OnConnect注册的回调
+type BusManager struct {
+	kind       string
+	mut        sync.Mutex
+	conn       *dbus.Conn
+	hooks      []OnConnectFunc
+	started    bool
+	state      int32 //BusState
+	reconnects uint32
+	lastErr    error
+	done       chan struct{}
+}
+
+var (
+	busLock     sync.Mutex
+	busManagers = map[string]*BusManager{}
+)
+
+// GetBus 获取指定类型总线的连接管理器，同类型总线全局共享一条连接
+func GetBus(kind string) *BusManager {
+	busLock.Lock()
+	defer busLock.Unlock()
+	m, has := busManagers[kind]
+	if !has {
+		m = &BusManager{kind: kind, done: make(chan struct{})}
+		busManagers[kind] = m
+	}
+	return m
+}
+
+// CloseBus 关闭所有总线连接，不再重连
+func CloseBus() {
+	busLock.Lock()
+	defer busLock.Unlock()
+	for kind, m := range busManagers {
+		m.Close()
+		delete(busManagers, kind)
+	}
+}
+
+// OnConnect 注册连接建立后的回调，如果当前已连接则立即执行一次
+func (m *BusManager) OnConnect(fn OnConnectFunc) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.hooks = append(m.hooks, fn)
+	if m.conn != nil && m.State() == BusConnected {
+		return fn(m.conn)
+	}
+	return nil
+}
+
+// Start 建立连接并执行回调，失败直接返回错误；连接成功后开始监听断开事件
+func (m *BusManager) Start() error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.started {
+		return nil
+	}
+	if err := m.connect(); err != nil {
+		return err
+	}
+	m.started = true
+	go m.watch(m.conn)
+	return nil
+}
+
+// Conn 获取当前连接，未启动时自动启动
+func (m *BusManager) Conn() (*dbus.Conn, error) {
+	if err := m.Start(); err != nil {
+		log.Warnf("init conn error.%v", err)
+		return nil, errors.New("init conn error")
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.State() != BusConnected {
+		return nil, errors.New("bus disconnected")
+	}
+	return m.conn, nil
+}
+
+// State 获取连接状态
+func (m *BusManager) State() BusState {
+	return BusState(atomic.LoadInt32(&m.state))
+}
+
+// Reconnects 获取重连成功的次数
+func (m *BusManager) Reconnects() uint32 {
+	return atomic.LoadUint32(&m.reconnects)
+}
+
+// LastError 获取最近一次连接失败的原因
+func (m *BusManager) LastError() error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.lastErr
+}
+
+// Close 关闭连接，不再重连
+func (m *BusManager) Close() {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	select {
+	case <-m.done:
+		return
+	default:
+	}
+	close(m.done)
+	if m.conn != nil {
+		_ = m.conn.Close()
+	}
+	m.setState(BusDisconnected)
+}
+
+//----------------------辅助函数------------------------
+
+//connect 建立新连接并依次执行回调，调用方需持有锁
+func (m *BusManager) connect() error {
+	m.setState(BusConnecting)
+	var conn *dbus.Conn
+	var err error
+	if m.kind == BusSystem {
+		conn, err = dbus.ConnectSystemBus()
+	} else {
+		conn, err = dbus.ConnectSessionBus()
+	}
+	if err != nil {
+		m.lastErr = err
+		m.setState(BusDisconnected)
+		return err
+	}
+	for _, fn := range m.hooks {
+		if err = fn(conn); err != nil {
+			_ = conn.Close()
+			m.lastErr = err
+			m.setState(BusDisconnected)
+			return err
+		}
+	}
+	m.conn = conn
+	m.lastErr = nil
+	m.setState(BusConnected)
+	return nil
+}
+
+//watch 监听连接断开，断开后按指数退避重连
+func (m *BusManager) watch(conn *dbus.Conn) {
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-conn.Context().Done():
+		}
+		log.Warnf("%s bus disconnected, try to reconnect", m.kind)
+		m.setState(BusDisconnected)
+		delay := minReconnectDelay
+		for {
+			select {
+			case <-m.done:
+				return
+			case <-time.After(delay):
+			}
+			m.mut.Lock()
+			err := m.connect()
+			conn = m.conn
+			m.mut.Unlock()
+			if err == nil {
+				atomic.AddUint32(&m.reconnects, 1)
+				log.Infof("%s bus reconnected", m.kind)
+				break
+			}
+			log.Errorf("reconnect %s bus error:[%s]", m.kind, err.Error())
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+		}
+	}
+}
+
+func (m *BusManager) setState(state BusState) {
+	atomic.StoreInt32(&m.state, int32(state))
+}
@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"errors"
 	"github.com/godbus/dbus/v5"
 	"github.com/jandre/procfs"
 	log "github.com/sirupsen/logrus"
@@ -9,25 +8,10 @@ import (
 
 const orgFreedesktopDBus = "org.freedesktop.DBus"
 
-func GetDbusSender(name string) (string, error) {
-	conn, err := dbus.SessionBus()
-	if err != nil {
-		log.Warnf("init conn error.%v", err)
-		return "", errors.New("init conn error")
-	}
-
-	pid, err := GetConnPID(conn, name)
-	if err != nil {
-		log.Errorf("CheckSender get pid error:[%s]", err.Error())
-		return "", err
-	}
-
-	path, err := GetProcessPath(int(pid))
-	if err != nil {
-		log.Errorf("CheckSender get exe path error:[%s]", err.Error())
-	}
-	return path, err
-}
+const (
+	BusSession = "session"
+	BusSystem  = "system"
+)
 
 // GetConnPID 获取conn进程ID
 func GetConnPID(conn *dbus.Conn, name string) (pid uint32, err error) {
@@ -36,8 +20,62 @@ func GetConnPID(conn *dbus.Conn, name string) (pid uint32, err error) {
 	return
 }
 
+// GetConnUID 获取conn进程所属用户ID
+func GetConnUID(conn *dbus.Conn, name string) (uid uint32, err error) {
+	err = conn.BusObject().Call(orgFreedesktopDBus+".GetConnectionUnixUser",
+		0, name).Store(&uid)
+	return
+}
+
 // GetProcessPath 获取conn进程path
 func GetProcessPath(pid int) (exe string, err error) {
 	process, err := procfs.NewProcess(pid, true)
-	return process.Exe, err
+	if err != nil {
+		return "", err
+	}
+	return process.Exe, nil
+}
+
+// Caller dbus方法调用方信息
+type Caller struct {
+	Sender string //调用方的unique name
+	PID    uint32
+	UID    uint32
+	Exe    string //调用方可执行文件路径
+}
+
+//SenderResolver 根据dbus sender获取调用方信息
+type SenderResolver interface {
+	Resolve(sender string) (*Caller, error)
+}
+
+//busSenderResolver 通过服务所在总线查询调用方信息
+type busSenderResolver struct{}
+
+func (busSenderResolver) Resolve(sender string) (*Caller, error) {
+	conn, err := GetBus(Conf().Service.Bus).Conn()
+	if err != nil {
+		return nil, err
+	}
+	pid, err := GetConnPID(conn, sender)
+	if err != nil {
+		log.Errorf("resolve sender get pid error:[%s]", err.Error())
+		return nil, err
+	}
+	uid, err := GetConnUID(conn, sender)
+	if err != nil {
+		log.Errorf("resolve sender get uid error:[%s]", err.Error())
+		return nil, err
+	}
+	exe, err := GetProcessPath(int(pid))
+	if err != nil {
+		log.Errorf("resolve sender get exe path error:[%s]", err.Error())
+		return nil, err
+	}
+	return &Caller{Sender: sender, PID: pid, UID: uid, Exe: exe}, nil
+}
+
+// NewBusSenderResolver 创建通过总线查询调用方信息的SenderResolver
+func NewBusSenderResolver() SenderResolver {
+	return busSenderResolver{}
 }
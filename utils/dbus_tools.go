@@ -2,6 +2,7 @@ package utils
 
 import (
 	"bufio"
+	"context"
 	"crypto/md5"
 	"errors"
 	"fmt"
@@ -12,18 +13,11 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
 )
 
-const (
-	ServiceName      = "com.uniontech.msgExample"
-	ServicePath      = "/com/uniontech/msgExample"
-	ServiceInterface = "com.uniontech.msgExample"
-)
-
 // UserInfo convert dbus UserInfo prop
 type UserInfo struct {
 	Uid          string
@@ -53,31 +47,44 @@ type WrapError struct {
 	*dbus.Error
 }
 
+//
+// NewError
+//  @Description: 转换为dbus错误，错误名为<service.interface>.Error.<ErrorKind>，
+//  参数为错误信息及错误码(HTTP状态码或服务端错误码，没有时为-1)
+//  @param err
+//  @return WrapError
+//
 func NewError(err error) WrapError {
 	if nil == err {
 		return WrapError{
 			Error: nil,
 		}
 	}
-	pc, _, _, _ := runtime.Caller(1)
-	details := runtime.FuncForPC(pc)
-	funcFullName := details.Name()
-	names := strings.Split(funcFullName, ".")
-	method := ServiceName + "." + names[len(names)-1]
+	name := Conf().Service.Interface + ".Error." + string(KindOf(err))
 	return WrapError{
-		Error: dbus.NewError(method, []interface{}{err.Error()}),
+		Error: dbus.NewError(name, []interface{}{err.Error(), ErrorCode(err)}),
 	}
 }
 
 const bufferSize = 1024 * 4
 
-// returns MD5 checksum of filename and it"s size
-func md5sumAndsize(filename string, m5 bool) (int64, string, error) {
-	info, err := os.Stat(filename)
+// returns MD5 checksum of filename and it"s size, filename以ctx中设置的用户的权限打开
+func md5sumAndsize(ctx context.Context, filename string, m5 bool) (int64, string, error) {
+	// O_NONBLOCK避免打开管道时阻塞，普通文件不受影响
+	file, err := openFile(ctx, filename, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		log.Errorf("md5sumAndsize open error:[%#v]", err)
+		if os.IsNotExist(err) || os.IsPermission(err) {
+			return 0, "", err
+		}
+		return 0, "", errors.New("file opt error")
+	}
+	defer file.Close()
+	info, err := file.Stat()
 	if err != nil {
 		log.Errorf("md5sumAndsize stat error:[%#v]", err)
 		return 0, "", errors.New("file opt error")
-	} else if info.IsDir() {
+	} else if !info.Mode().IsRegular() {
 		return 0, "", errors.New("path or keys should be file")
 	}
 
@@ -85,13 +92,6 @@ func md5sumAndsize(filename string, m5 bool) (int64, string, error) {
 		return info.Size(), "", nil
 	}
 
-	file, err := os.Open(filename)
-	if err != nil {
-		log.Errorf("md5sumAndsize open error:[%#v]", err)
-		return 0, "", errors.New("file opt error")
-	}
-	defer file.Close()
-
 	hash := md5.New()
 	for buf, reader := make([]byte, bufferSize), bufio.NewReader(file); ; {
 		n, err := reader.Read(buf)
@@ -109,36 +109,98 @@ func md5sumAndsize(filename string, m5 bool) (int64, string, error) {
 	return info.Size(), checksum, nil
 }
 
-func CheckWriteFile(v string) error {
+// FileSize 以ctx中设置的用户的权限获取文件大小
+func FileSize(ctx context.Context, filename string) (int64, error) {
+	size, _, err := md5sumAndsize(ctx, filename, false)
+	return size, err
+}
+
+//
+// CheckWriteFile
+//  @Description: 以ctx中设置的用户的权限检查能否写入文件v，文件不存在时创建所在目录
+//  @param ctx
+//  @param v
+//  @return error
+//
+func CheckWriteFile(ctx context.Context, v string) error {
 	if len(v) == 0 {
-		panic("xxxxx")
+		return ErrInvalidParam
 	}
-
-	var isDir, canWrite bool
-	err := FullPathCheck(v, &isDir, &canWrite)
-	if err == nil {
-		if canWrite {
-			return nil
+	return asOwner(ctx, func() error {
+		info, err := os.Stat(v)
+		if err == nil {
+			if info.IsDir() {
+				return errors.New("path or keys should be file")
+			}
+			// 只检查写权限，不截断文件
+			fd, err := os.OpenFile(v, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+			if err != nil {
+				log.Errorf("CheckWriteFile open error:[%#v]", err)
+				return ErrPermission
+			}
+			return fd.Close()
 		}
-		if isDir {
-			return errors.New("path or keys should be file")
+		if os.IsPermission(err) {
+			return ErrPermission
+		} else if !os.IsNotExist(err) {
+			log.Errorf("CheckWriteFile stat error:[%#v]", err)
+			return errors.New("file opt error")
 		}
-		return errors.New("file opt error")
-	}
 
-	if !os.IsNotExist(err) {
-		log.Errorf("CheckWriteFile stat error:[%#v]", err)
-		return errors.New("file opt error")
+		// 不存在，创建
+		i := strings.LastIndex(v, "/")
+		dir := v[:i]
+		if err := MakeDir(dir); err != nil {
+			if os.IsPermission(err) {
+				return ErrPermission
+			}
+			return errors.New("file opt error")
+		}
+		return nil
+	})
+}
+
+//
+// CheckFileOwner
+//  @Description: 检查uid是否可以写入文件，文件已存在时需要属于uid，否则所在目录需要属于uid，root不做限制
+//  @param v 文件路径，需要是绝对路径
+//  @param uid
+//  @return error
+//
+func CheckFileOwner(v string, uid uint32) error {
+	if !filepath.IsAbs(v) {
+		return &Error{Kind: KindInvalidArgument, Code: -1, Message: "path should be absolute"}
+	}
+	if uid == 0 {
+		return nil
+	}
+	for item := filepath.Clean(v); ; item = filepath.Dir(item) {
+		info, err := os.Stat(item)
+		if os.IsNotExist(err) && item != "/" {
+			// 不存在的目录由CheckWriteFile创建，检查上一级
+			continue
+		} else if err != nil {
+			return errors.New("file opt error")
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || st.Uid != uid {
+			return ErrPermission
+		}
+		return nil
 	}
+}
 
-	// 不存在，创建
-	i := strings.LastIndex(v, "/")
-	dir := v[:i]
-	err = MakeDir(dir)
+// FileOwner 获取文件属主
+func FileOwner(v string) (uint32, error) {
+	info, err := os.Stat(v)
 	if err != nil {
-		return errors.New("file opt error")
+		return 0, err
 	}
-	return nil
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, ErrPermission
+	}
+	return st.Uid, nil
 }
 
 func MakeDir(dir string) error {
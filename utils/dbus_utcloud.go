@@ -1,19 +1,19 @@
 package utils
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/godbus/dbus/v5"
+	"github.com/jibenliu/utMsgDaemon/utils/utcloud"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
-	"net/http"
 )
 
 const (
-	utcloudDBusService = "com.deepin.utcloud.Daemon"
-	utcloudDBusPath    = "/com/deepin/utcloud/Daemon"
-	utcloudServer      = "http://utcloud-pre.chinauos.com"
+	TransportDaemon = "daemon" //通过utcloud daemon上传、删除
+	TransportDirect = "direct" //使用token直接访问utcloud服务端及对象存储
+	TransportAuto   = "auto"   //有token时直接访问，否则通过utcloud daemon
 )
 
 type UtResponse struct {
@@ -40,9 +40,6 @@ type OsInfo struct {
 //  @return string
 //
 func AddOS(token string) (string, error) {
-	head := map[string]string{
-		"token": token,
-	}
 	viper.SetConfigName("os-version")
 	viper.AddConfigPath("/etc/")
 	viper.SetConfigType("ini")
@@ -50,26 +47,17 @@ func AddOS(token string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	params := map[string]interface{}{
-		"os_edition": viper.GetString("Version.EditionName"),
-		"os_name":    "uos",
-		"os_version": fmt.Sprintf("%s.%s", viper.GetString("Version.MajorVersion"), viper.GetString("Version.MinorVersion")),
+	info := utcloud.OSInfo{
+		Edition: viper.GetString("Version.EditionName"),
+		Name:    "uos",
+		Version: fmt.Sprintf("%s.%s", viper.GetString("Version.MajorVersion"), viper.GetString("Version.MinorVersion")),
 	}
-	data, err := HTTPCall(http.MethodPut, utcloudServer+"/api/v0/access/os", head, nil, params)
+	id, err := apiClient(token).AddOS(context.Background(), info)
 	if err != nil {
 		log.Errorf("add os error:[%s]", err.Error())
 		return "", err
 	}
-	var response = UtResponse{}
-	if err := json.Unmarshal(data, &response); err != nil {
-		log.Errorf("add os response error:[%s]", err.Error())
-		return "", err
-	}
-	log.Debugf("add os response :[%#v]", response)
-	if !response.Result {
-		return "", errors.New(response.Msg)
-	}
-	return response.Data.Id, nil
+	return id, nil
 }
 
 // AddApp 添加应用
@@ -79,36 +67,25 @@ func AddOS(token string) (string, error) {
 //  @return string
 //
 func AddApp(token string) (string, error) {
-	head := map[string]string{
-		"token": token,
-	}
 	binPath, _ := GetRunPath()
-	params := map[string]interface{}{
-		"callback_dbus_method": ServiceName + ".Callback",
-		"callback_dbus_name":   ServiceName,
-		"callback_dbus_path":   ServicePath,
-		"description":          "测试用demo",
-		"developer":            "ut003500",
-		"email":                "ut003500@uniontech.com",
-		"name":                 "测试云服务对接app",
-		"path":                 binPath,
-		"show_switcher":        false,
-	}
-	data, err := HTTPCall(http.MethodPut, utcloudServer+"/api/v0/access/app", head, nil, params)
+	cfg := Conf()
+	app := utcloud.AppInfo{
+		CallbackMethod: cfg.Service.Interface + ".Callback",
+		CallbackName:   cfg.Service.Name,
+		CallbackPath:   cfg.Service.Path,
+		Description:    cfg.App.Description,
+		Developer:      cfg.App.Developer,
+		Email:          cfg.App.Email,
+		Name:           cfg.App.Name,
+		Path:           binPath,
+		ShowSwitcher:   cfg.App.ShowSwitcher,
+	}
+	id, err := apiClient(token).AddApp(context.Background(), app)
 	if err != nil {
-		log.Errorf("add os error:[%s]", err.Error())
-		return "", err
-	}
-	var response = UtResponse{}
-	if err := json.Unmarshal(data, &response); err != nil {
-		log.Errorf("add app host response error:[%s]", err.Error())
+		log.Errorf("add app error:[%s]", err.Error())
 		return "", err
 	}
-	log.Debugf("add app response :[%#v]", response)
-	if !response.Result {
-		return "", errors.New(response.Msg)
-	}
-	return response.Data.Id, nil
+	return id, nil
 }
 
 // BindApp2OS
@@ -120,84 +97,56 @@ func AddApp(token string) (string, error) {
 //  @return error
 //
 func BindApp2OS(token, osId, appId string) (bool, error) {
-	head := map[string]string{
-		"token": token,
-	}
-	params := map[string]interface{}{
-		"appids": []string{
-			appId,
-		},
-		"osid": osId,
-	}
-	data, err := HTTPCall(http.MethodPut, utcloudServer+"/api/v0/access/attach", head, nil, params)
+	err := apiClient(token).AttachApps(context.Background(), osId, []string{appId})
 	if err != nil {
 		log.Errorf("bind app to os error:[%s]", err.Error())
 		return false, err
 	}
-	var response = UtResponse{}
-	if err := json.Unmarshal(data, &response); err != nil {
-		log.Errorf("bind app to os host response error:[%s]", err.Error())
-		return false, err
-	}
-	log.Debugf("bind app to os response [%#v]", response)
-	if !response.Result {
-		return false, errors.New(response.Msg)
-	}
 	return true, nil
 }
 
-type uploadResponse struct {
-	Code int `json:"code"`
-	Data struct {
-		Acl struct {
-			SignUrl string `json:"sign_url"`
-		} `json:"acl"`
-		Uss int `json:"uss"`
-	} `json:"data"`
-	Err struct {
-	} `json:"err"`
-	Msg    string `json:"msg"`
-	Result bool   `json:"result"`
-}
-
 //
 //  uploadFile
-//  @Description:通过临时授权上传文件
+//  @Description:通过临时授权上传文件，大文件分片上传，服务端不支持分片上传时单次上传，local存储直接以key保存
+//  @param ctx 取消时中断上传
 //  @param token
-//  @param fName
+//  @param key 云端文件key
+//  @param fName 本地文件路径
+//  @param progress
 //
-func uploadFile(token, fName string) (bool, error) {
-	head := map[string]string{
-		"token": token,
-	}
-	_, hash, _ := md5sumAndsize(fName, true)
-	binPath, _ := GetRunPath()
-	params := map[string]interface{}{
-		"bin_path": binPath,
-		"key":      fName,
-		"method":   "put",
-		"md5":      hash,
-	}
-	data, err := HTTPCall(http.MethodGet, utcloudServer+"/api/v0/app/acl", head, params, nil)
+func uploadFile(ctx context.Context, token, key, fName string, progress ProgressFunc) (bool, error) {
+	size, hash, _ := md5sumAndsize(ctx, fName, true)
+	store, err := CurrentStorage()
 	if err != nil {
-		log.Errorf("upload file error:[%s]", err.Error())
-		return false, err
-	}
-	var response = uploadResponse{}
-	if err := json.Unmarshal(data, &response); err != nil {
-		log.Errorf("upload file host response error:[%s]", err.Error())
 		return false, err
 	}
-	log.Debugf("upload file response [%#v]", response)
-	if !response.Result {
-		return false, errors.New(response.Msg)
+	if !store.Presigned() {
+		if err := store.Put(ctx, key, fName, hash, progress); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if threshold := Conf().Transfer.MultipartThreshold; threshold > 0 && size >= threshold {
+		err := multipartUpload(ctx, token, key, fName, hash, progress)
+		if err == nil {
+			return true, nil
+		} else if !errors.Is(err, errMultipartUnsupported) {
+			return false, err
+		}
+		log.Warnf("upload %s error:[%s], fallback to single put", key, err.Error())
 	}
-	bucket, err := GetBucket(response.Data.Acl.SignUrl)
+	binPath, _ := GetRunPath()
+	acl, err := apiClient(token).GetACL(ctx, utcloud.ACLRequest{
+		BinPath: binPath,
+		Key:     key,
+		Method:  utcloud.ACLPut,
+		MD5:     hash,
+	})
 	if err != nil {
+		log.Errorf("upload file error:[%s]", err.Error())
 		return false, err
 	}
-
-	err = PutObject(bucket, response.Data.Acl.SignUrl, fName, hash)
+	err = store.Put(ctx, acl.SignURL, fName, hash, progress)
 	if err != nil {
 		return false, err
 	}
@@ -213,65 +162,70 @@ func uploadFile(token, fName string) (bool, error) {
 //  @return error
 //
 func noteMetaData(token, fName string) ([]byte, error) {
-	head := map[string]string{
-		"token": token,
-	}
 	binPath, _ := GetRunPath()
-	params := map[string]interface{}{
-		"bin_path": binPath,
-		"key":      fName,
-	}
-	data, err := HTTPCall(http.MethodPut, utcloudServer+"/api/v0/app/meta", head, nil, params)
+	id, err := apiClient(token).PutMeta(context.Background(), binPath, fName)
 	if err != nil {
 		log.Errorf("note upload error:[%s]", err.Error())
 		return []byte(""), err
 	}
-	var response = UtResponse{}
-	if err := json.Unmarshal(data, &response); err != nil {
-		log.Errorf("note upload host response error:[%s]", err.Error())
-		return []byte(""), err
-	}
-	log.Debugf("note upload response [%#v]", response)
-	if !response.Result {
-		return []byte(""), errors.New(response.Msg)
-	}
-	return []byte(response.Data.Id), nil
+	return []byte(id), nil
 }
 
 //
 // UploadUtDaemon
-//  @Description: 上传utcloud服务文件
+//  @Description: 上传utcloud服务文件，以文件路径为key
+//  @param ctx 取消时中断上传
 //  @param fName
+//  @param progress 上传进度回调，可为nil
 //  @return bool
 //  @return error
 //
-func UploadUtDaemon(token, fName string) ([]byte, error) {
-	ok, err := uploadFile(token, fName)
+func UploadUtDaemon(ctx context.Context, token, fName string, progress ProgressFunc) ([]byte, error) {
+	return UploadToKey(ctx, token, fName, fName, progress)
+}
+
+//
+// UploadToKey
+//  @Description: 上传本地文件到指定的云端key
+//  @param ctx 取消时中断上传，本地文件以ctx中设置的用户的权限读取
+//  @param token
+//  @param key 云端文件key
+//  @param fName 本地文件路径
+//  @param progress 上传进度回调，可为nil
+//  @return []byte
+//  @return error
+//
+func UploadToKey(ctx context.Context, token, key, fName string, progress ProgressFunc) ([]byte, error) {
+	ok, err := uploadFile(ctx, token, key, fName, progress)
 	if err != nil {
 		return []byte(""), err
 	}
 	if !ok {
 		return []byte(""), errors.New("upload fail without error")
 	}
-	return noteMetaData(token, fName)
+	if store, _ := CurrentStorage(); store != nil && !store.Presigned() {
+		// 未经过服务端，不需要通知
+		return []byte(key), nil
+	}
+	return noteMetaData(token, key)
 }
 
 //
 // UploadByDaemon
 //  @Description: 通过utcloud上传文件
+//  @param ctx 取消时不再等待utcloud daemon返回
 //  @param fName
 //  @return bool
 //  @return error
 //
-func UploadByDaemon(fName string) ([]byte, error) {
-	conn, err := dbus.SessionBus()
+func UploadByDaemon(ctx context.Context, fName string) ([]byte, error) {
+	conn, err := GetBus(Conf().Utcloud.DBusBus).Conn()
 	if err != nil {
-		log.Warnf("init conn error.%v", err)
-		return []byte(""), errors.New("init conn error")
+		return []byte(""), err
 	}
 	var s []byte
-	object := conn.Object("com.deepin.utcloud.Daemon", "/com/deepin/utcloud/Daemon")
-	err = object.Call("Upload", 0, fName).Store(&s)
+	object := conn.Object(Conf().Utcloud.DBusService, dbus.ObjectPath(Conf().Utcloud.DBusPath))
+	err = object.CallWithContext(ctx, "Upload", 0, fName).Store(&s)
 	if err != nil {
 		fmt.Println("upload file by utcloud daemon fail:", err)
 		return []byte(""), err
@@ -279,13 +233,38 @@ func UploadByDaemon(fName string) ([]byte, error) {
 	return s, nil
 }
 
-type deleteResponse struct {
-	Code int    `json:"code"`
-	Data string `json:"data"`
-	Err  struct {
-	} `json:"err"`
-	Msg    string `json:"msg"`
-	Result bool   `json:"result"`
+//
+// DownloadUtDaemon
+//  @Description: 通过临时授权下载utcloud服务文件，服务端返回md5时校验通过后才写入localFile，local存储直接按key读取
+//  @param ctx 取消时中断下载
+//  @param token
+//  @param fName 云端文件key
+//  @param localFile 本地文件路径
+//  @param progress 下载进度回调，可为nil
+//  @return error
+//
+func DownloadUtDaemon(ctx context.Context, token, fName, localFile string, progress ProgressFunc) error {
+	store, err := CurrentStorage()
+	if err != nil {
+		return err
+	}
+	if !store.Presigned() {
+		return store.Get(ctx, fName, localFile, "", progress)
+	}
+	binPath, _ := GetRunPath()
+	acl, err := apiClient(token).GetACL(ctx, utcloud.ACLRequest{
+		BinPath: binPath,
+		Key:     fName,
+		Method:  utcloud.ACLGet,
+	})
+	if err != nil {
+		log.Errorf("download file error:[%s]", err.Error())
+		return err
+	}
+	if len(acl.MD5) == 0 {
+		log.Warnf("download %s without md5, skip verification", fName)
+	}
+	return store.Get(ctx, acl.SignURL, localFile, acl.MD5, progress)
 }
 
 //
@@ -296,29 +275,20 @@ type deleteResponse struct {
 //  @return error
 //
 func DeleteDaemon(token, fName string) (bool, error) {
-	head := map[string]string{
-		"token": token,
+	if store, err := CurrentStorage(); err != nil {
+		return false, err
+	} else if !store.Presigned() {
+		if err := store.Delete(context.Background(), fName); err != nil {
+			return false, err
+		}
+		return true, nil
 	}
 	binPath, _ := GetRunPath()
-	params := map[string]interface{}{
-		"bin_path": binPath,
-		"key":      fName,
-	}
-	data, err := HTTPCall(http.MethodDelete, utcloudServer+"/api/v0/app/meta", head, nil, params)
-	if err != nil {
+	if err := apiClient(token).DeleteMeta(context.Background(), binPath, fName); err != nil {
 		log.Errorf("delete file error:[%s]", err.Error())
 		return false, err
 	}
-	var response = deleteResponse{}
-	if err := json.Unmarshal(data, &response); err != nil {
-		log.Errorf("delete file host response error:[%s]", err.Error())
-		return false, err
-	}
-	log.Debugf("delete file response [%#v]", response)
-	if !response.Result {
-		return false, errors.New(response.Msg)
-	}
-	return response.Result, nil
+	return true, nil
 }
 
 //
@@ -329,13 +299,12 @@ func DeleteDaemon(token, fName string) (bool, error) {
 //  @return error
 //
 func DeleteByDaemon(fName string) (string, error) {
-	conn, err := dbus.SessionBus()
+	conn, err := GetBus(Conf().Utcloud.DBusBus).Conn()
 	if err != nil {
-		log.Warnf("init conn error.%v", err)
-		return "", errors.New("init conn error")
+		return "", err
 	}
 	var s string
-	object := conn.Object("com.deepin.utcloud.Daemon", "/com/deepin/utcloud/Daemon")
+	object := conn.Object(Conf().Utcloud.DBusService, dbus.ObjectPath(Conf().Utcloud.DBusPath))
 	err = object.Call("Delete", 0, fName).Store(&s)
 	if err != nil {
 		fmt.Println("delete file by utcloud daemon fail:", err)
@@ -343,3 +312,127 @@ func DeleteByDaemon(fName string) (string, error) {
 	}
 	return s, nil
 }
+
+//
+// GetUserInfoByDaemon
+//  @Description: 获取utcloud daemon当前登录的用户信息
+//  @return UserInfo
+//  @return error
+//
+func GetUserInfoByDaemon() (UserInfo, error) {
+	var info UserInfo
+	conn, err := GetBus(Conf().Utcloud.DBusBus).Conn()
+	if err != nil {
+		return info, err
+	}
+	return getUserInfo(conn)
+}
+
+//
+// GetTokenByDaemon
+//  @Description: 通过utcloud daemon获取当前登录用户的token
+//  @return string
+//  @return error
+//
+func GetTokenByDaemon() (string, error) {
+	cfg := Conf()
+	if len(cfg.Utcloud.TokenMethod) == 0 {
+		return "", errors.New("utcloud token method not configured")
+	}
+	conn, err := GetBus(cfg.Utcloud.DBusBus).Conn()
+	if err != nil {
+		return "", err
+	}
+	var token string
+	object := conn.Object(cfg.Utcloud.DBusService, dbus.ObjectPath(cfg.Utcloud.DBusPath))
+	err = object.Call(cfg.Utcloud.DBusIface+"."+cfg.Utcloud.TokenMethod, 0).Store(&token)
+	if err != nil {
+		log.Errorf("get token by utcloud daemon error:[%s]", err.Error())
+		return "", err
+	}
+	return token, nil
+}
+
+//
+// WatchUserInfo
+//  @Description: 监听utcloud daemon的UserInfo属性变化，连接建立后先回调一次当前值，总线重连后自动重新监听
+//  @param fn 用户信息变化回调
+//  @return error
+//
+func WatchUserInfo(fn func(UserInfo)) error {
+	cfg := Conf()
+	bus := GetBus(cfg.Utcloud.DBusBus)
+	err := bus.OnConnect(func(conn *dbus.Conn) error {
+		return watchUserInfo(conn, cfg, fn)
+	})
+	if err != nil {
+		return err
+	}
+	return bus.Start()
+}
+
+func watchUserInfo(conn *dbus.Conn, cfg *Config, fn func(UserInfo)) error {
+	// 只接收utcloud daemon发出的信号，其他连接伪造的登出信号会清除token
+	err := conn.AddMatchSignal(
+		dbus.WithMatchSender(cfg.Utcloud.DBusService),
+		dbus.WithMatchObjectPath(dbus.ObjectPath(cfg.Utcloud.DBusPath)),
+		dbus.WithMatchInterface(propertiesInterface),
+		dbus.WithMatchMember("PropertiesChanged"),
+		dbus.WithMatchArg(0, cfg.Utcloud.DBusIface),
+	)
+	if err != nil {
+		return err
+	}
+	ch := make(chan *dbus.Signal, 10)
+	conn.Signal(ch)
+	// 回调可能会用到总线连接，不能在OnConnect回调中同步执行
+	go func() {
+		// utcloud daemon可能未运行，不影响连接
+		if info, err := getUserInfo(conn); err == nil {
+			fn(info)
+		} else {
+			log.Warnf("get utcloud user info error:[%s]", err.Error())
+		}
+		// 连接关闭后godbus会关闭ch
+		for sig := range ch {
+			if sig.Path != dbus.ObjectPath(cfg.Utcloud.DBusPath) || sig.Name != propertiesInterface+".PropertiesChanged" || len(sig.Body) < 2 {
+				continue
+			}
+			// 同一连接上其他监听注册的匹配规则也会收到信号，发送方需要是utcloud daemon服务名的当前所有者
+			if !nameOwnedBy(conn, cfg.Utcloud.DBusService, sig.Sender) {
+				log.Warnf("ignore utcloud user info change from %s", sig.Sender)
+				continue
+			}
+			changed, _ := sig.Body[1].(map[string]dbus.Variant)
+			if v, has := changed["UserInfo"]; has {
+				var info UserInfo
+				info.FromDBus(v)
+				fn(info)
+			}
+		}
+	}()
+	return nil
+}
+
+//nameOwnedBy sender是否为服务名name的当前所有者
+func nameOwnedBy(conn *dbus.Conn, name, sender string) bool {
+	if sender == name {
+		return true
+	}
+	var owner string
+	if err := conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, name).Store(&owner); err != nil {
+		return false
+	}
+	return len(owner) != 0 && owner == sender
+}
+
+func getUserInfo(conn *dbus.Conn) (UserInfo, error) {
+	var info UserInfo
+	cfg := Conf()
+	v, err := conn.Object(cfg.Utcloud.DBusService, dbus.ObjectPath(cfg.Utcloud.DBusPath)).GetProperty(cfg.Utcloud.DBusIface + ".UserInfo")
+	if err != nil {
+		return info, err
+	}
+	info.FromDBus(v)
+	return info, nil
+}
@@ -0,0 +1,337 @@
+package utils
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	partFileSuffix = ".part"
+	downloadCpDir  = "downloads"
+)
+
+var contentRangeRe = regexp.MustCompile(`^bytes \d+-\d+/(\d+)$`)
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+//rangeGetter 请求对象[start, end]范围内的数据，start小于0时请求整个对象，
+//416时返回errRangeNotSatisfiable，oss及S3兼容存储分别实现
+type rangeGetter func(ctx context.Context, start, end int64) (*rangeResponse, error)
+
+type rangeResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       io.ReadCloser
+}
+
+//downloadCheckpoint 分段下载断点，保存在状态目录下，云端文件变化或分段大小变化时失效
+type downloadCheckpoint struct {
+	LocalFile string       `json:"local_file"`
+	Size      int64        `json:"size"`
+	ETag      string       `json:"etag"`
+	PartSize  int64        `json:"part_size"`
+	Parts     map[int]bool `json:"parts"` //已完成的分段
+}
+
+//
+// getObjectToFile
+//  @Description: 按Range分段并发下载到localFile.part，每段完成后记录断点，中断后再次下载时跳过已完成的分段；
+//  全部完成并校验后重命名为localFile，目标文件不会出现不完整的内容
+//  @param ctx 取消时中断下载，保留.part文件及断点；本地文件以ctx中设置的用户的权限创建
+//  @param get 请求对象数据
+//  @param localFile
+//  @param md5sum 文件md5，为空时使用非分片上传对象的ETag校验
+//  @param progress 下载进度回调，可为nil
+//  @return error
+//
+func getObjectToFile(ctx context.Context, get rangeGetter, localFile, md5sum string, progress ProgressFunc) error {
+	cfg := Conf()
+	info, ranged, err := probeObject(ctx, get)
+	if err != nil {
+		return err
+	}
+	size, etag := info.Size, info.ETag
+	if len(md5sum) == 0 && isMD5ETag(etag) {
+		md5sum = normalizeETag(etag)
+	}
+	tmp := localFile + partFileSuffix
+	cpFile := downloadCheckpointFile(cfg, localFile)
+	if !ranged {
+		// 不支持Range时整体下载，无法断点续传
+		log.Warnf("object of %s does not support range, download whole", localFile)
+		err = getObjectWhole(ctx, get, tmp, size, progress)
+	} else {
+		err = getObjectRanges(ctx, get, tmp, cpFile, size, etag, progress)
+	}
+	if err != nil {
+		return err
+	}
+	if len(md5sum) != 0 {
+		_, actual, err := md5sumAndsize(ctx, tmp, true)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(actual, md5sum) {
+			log.Errorf("get object md5 mismatch, expect:[%s] actual:[%s]", md5sum, actual)
+			_ = asOwner(ctx, func() error { return os.Remove(tmp) })
+			_ = os.Remove(cpFile)
+			return ErrMD5Mismatch
+		}
+	}
+	if err := asOwner(ctx, func() error { return os.Rename(tmp, localFile) }); err != nil {
+		return err
+	}
+	_ = os.Remove(cpFile)
+	return nil
+}
+
+//----------------------辅助函数------------------------
+
+//probeObject 请求第一个字节获取对象信息，返回是否支持Range
+func probeObject(ctx context.Context, get rangeGetter) (ObjectInfo, bool, error) {
+	resp, err := get(ctx, 0, 0)
+	if err == errRangeNotSatisfiable {
+		// 空对象
+		return ObjectInfo{}, false, nil
+	} else if err != nil {
+		return ObjectInfo{}, false, err
+	}
+	// 不支持Range时返回整个对象，这里只需要响应头
+	_ = resp.Body.Close()
+	info := ObjectInfo{ETag: resp.Header.Get("ETag")}
+	if isMD5ETag(info.ETag) {
+		info.MD5 = normalizeETag(info.ETag)
+	}
+	info.ModTime, _ = time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+	if resp.StatusCode != http.StatusPartialContent {
+		info.Size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+		return info, false, nil
+	}
+	match := contentRangeRe.FindStringSubmatch(resp.Header.Get("Content-Range"))
+	if match == nil {
+		return ObjectInfo{}, false, fmt.Errorf("invalid content range %q", resp.Header.Get("Content-Range"))
+	}
+	info.Size, _ = strconv.ParseInt(match[1], 10, 64)
+	return info, true, nil
+}
+
+func getObjectWhole(ctx context.Context, get rangeGetter, tmp string, size int64, progress ProgressFunc) error {
+	fd, err := openFile(ctx, tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	if size > 0 {
+		err = readRange(ctx, get, -1, size, fd, progress)
+	}
+	if serr := fd.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = asOwner(ctx, func() error { return os.Remove(tmp) })
+	}
+	return err
+}
+
+func getObjectRanges(ctx context.Context, get rangeGetter, tmp, cpFile string, size int64, etag string, progress ProgressFunc) error {
+	cfg := Conf()
+	cp := loadDownloadCheckpoint(cpFile)
+	if err := asOwner(ctx, func() error {
+		_, err := os.Stat(tmp)
+		return err
+	}); err != nil || cp == nil || cp.Size != size || cp.ETag != etag ||
+		cp.PartSize != cfg.Transfer.PartSize || len(etag) == 0 {
+		cp = &downloadCheckpoint{
+			LocalFile: tmp,
+			Size:      size,
+			ETag:      etag,
+			PartSize:  cfg.Transfer.PartSize,
+			Parts:     map[int]bool{},
+		}
+	} else {
+		log.Infof("resume download %s, %d parts finished", tmp, len(cp.Parts))
+	}
+	fd, err := openFile(ctx, tmp, os.O_CREATE|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if err := fd.Truncate(size); err != nil {
+		return err
+	}
+	if err := saveJSON(cpFile, cp); err != nil {
+		return err
+	}
+
+	count := int((size + cp.PartSize - 1) / cp.PartSize)
+	tracker := newPartTracker(size, progress)
+	var todo []int
+	for i := 1; i <= count; i++ {
+		if cp.Parts[i] {
+			_, length := rangeOf(cp, i)
+			tracker.update(i, length)
+			continue
+		}
+		todo = append(todo, i)
+	}
+	err = runParts(ctx, todo, func(ctx context.Context, number int) (string, error) {
+		return "", downloadPart(ctx, get, fd, cp, number, tracker)
+	}, func(number int, _ string) {
+		cp.Parts[number] = true
+		if err := saveJSON(cpFile, cp); err != nil {
+			log.Warnf("save download checkpoint error:[%s]", err.Error())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return fd.Sync()
+}
+
+//downloadPart 下载单个分段，失败时重试
+func downloadPart(ctx context.Context, get rangeGetter, fd *os.File, cp *downloadCheckpoint, number int, tracker *partTracker) error {
+	start, length := rangeOf(cp, number)
+	var err error
+	for i := 0; i < partRetries; i++ {
+		if i != 0 {
+			log.Warnf("download part %d of %s error:[%s], retry", number, cp.LocalFile, err.Error())
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(partRetryDelay * time.Duration(i)):
+			}
+		}
+		err = readRange(ctx, get, start, length, &offsetWriter{file: fd, offset: start}, func(done, total int64) {
+			tracker.update(number, done)
+		})
+		if err == nil {
+			return nil
+		}
+		tracker.update(number, 0)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+//readRange 读取从start开始的length字节写入writer，start小于0时读取整个对象；取消时关闭响应中断阻塞的读取
+func readRange(ctx context.Context, get rangeGetter, start, length int64, writer io.Writer, progress ProgressFunc) error {
+	end := start + length - 1
+	resp, err := get(ctx, start, end)
+	if err != nil {
+		return err
+	}
+	body := resp.Body
+	defer body.Close()
+	if start >= 0 && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("expect partial content, got status %d", resp.StatusCode)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = body.Close()
+		case <-stop:
+		}
+	}()
+	n, err := io.Copy(writer, newTransferReader(ctx, TransferDownload, body, length, progress))
+	if err != nil {
+		return err
+	}
+	if n != length {
+		return fmt.Errorf("expect %d bytes, got %d", length, n)
+	}
+	return nil
+}
+
+//ossRangeGetter 通过oss临时授权地址请求对象数据
+func ossRangeGetter(bucket *oss.Bucket, signUrl string) rangeGetter {
+	return func(ctx context.Context, start, end int64) (*rangeResponse, error) {
+		var opts []oss.Option
+		if start >= 0 {
+			opts = append(opts, oss.Range(start, end))
+		}
+		result, err := bucket.DoGetObjectWithURL(signUrl, opts)
+		if err != nil {
+			if serr, ok := err.(oss.ServiceError); ok && serr.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+				return nil, errRangeNotSatisfiable
+			}
+			return nil, err
+		}
+		return &rangeResponse{
+			StatusCode: result.Response.StatusCode,
+			Header:     result.Response.Headers,
+			Body:       result.Response.Body,
+		}, nil
+	}
+}
+
+func rangeOf(cp *downloadCheckpoint, number int) (int64, int64) {
+	start := int64(number-1) * cp.PartSize
+	if cp.Size-start < cp.PartSize {
+		return start, cp.Size - start
+	}
+	return start, cp.PartSize
+}
+
+//isMD5ETag 非分片上传的对象ETag为文件md5
+func isMD5ETag(etag string) bool {
+	v := strings.Trim(etag, `"`)
+	if len(v) != md5.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(v)
+	return err == nil
+}
+
+func normalizeETag(etag string) string {
+	return strings.ToLower(strings.Trim(etag, `"`))
+}
+
+//downloadCheckpointFile 断点文件路径，按本地文件路径区分
+func downloadCheckpointFile(cfg *Config, localFile string) string {
+	sum := sha256.Sum256([]byte(localFile))
+	return cfg.StatePath(filepath.Join(downloadCpDir, hex.EncodeToString(sum[:16])+".json"))
+}
+
+func loadDownloadCheckpoint(file string) *downloadCheckpoint {
+	cp := &downloadCheckpoint{}
+	if !loadJSON(file, cp) {
+		return nil
+	}
+	if cp.Parts == nil {
+		cp.Parts = map[int]bool{}
+	}
+	return cp
+}
+
+//offsetWriter 从offset开始顺序写入文件，多个分段可以并发写入同一文件
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
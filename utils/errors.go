@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/jibenliu/utMsgDaemon/utils/utcloud"
+)
+
+// ErrorKind 错误类型，导出到dbus的错误名为<service.interface>.Error.<ErrorKind>
+type ErrorKind string
+
+const (
+	KindFailed             ErrorKind = "Failed"             //未分类的错误
+	KindNotFound           ErrorKind = "NotFound"           //文件、云端记录或任务不存在
+	KindPermissionDenied   ErrorKind = "PermissionDenied"   //没有权限访问文件或云端资源
+	KindNetworkUnavailable ErrorKind = "NetworkUnavailable" //网络不可用或服务端暂时无法访问
+	KindQuotaExceeded      ErrorKind = "QuotaExceeded"      //超过云端配额、请求频率或磁盘空间不足
+	KindInvalidArgument    ErrorKind = "InvalidArgument"    //参数错误
+	KindConflict           ErrorKind = "Conflict"           //与当前状态冲突，如任务已结束、文件内容不一致
+	KindUnauthenticated    ErrorKind = "Unauthenticated"    //没有token或token已失效
+	KindCancelled          ErrorKind = "Cancelled"          //操作被取消
+)
+
+// Error 带类型的错误，Code为HTTP状态码或服务端错误码，没有时为-1
+type Error struct {
+	Kind    ErrorKind
+	Code    int32
+	Message string
+	Err     error //原始错误，如oss.ServiceError
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+var (
+	ErrNotExist     = &Error{Kind: KindNotFound, Code: http.StatusNotFound, Message: "record not exist"}
+	ErrInvalidParam = &Error{Kind: KindInvalidArgument, Code: -1, Message: "param invalid"}
+	ErrNoToken      = &Error{Kind: KindUnauthenticated, Code: -1, Message: "token not found"}
+	ErrNoFile       = &Error{Kind: KindNotFound, Code: -1, Message: "no such file or directory"}
+	ErrPermission   = &Error{Kind: KindPermissionDenied, Code: -1, Message: "permission denied"}
+	ErrOffline      = &Error{Kind: KindNetworkUnavailable, Code: -1, Message: "network unavailable"}
+)
+
+//
+// NewKindError
+//  @Description: 创建带类型的错误
+//  @param kind
+//  @param code HTTP状态码或服务端错误码，没有时为-1
+//  @param err 原始错误，Message使用其内容
+//  @return *Error
+//
+func NewKindError(kind ErrorKind, code int32, err error) *Error {
+	return &Error{Kind: kind, Code: code, Message: err.Error(), Err: err}
+}
+
+//
+// KindOf
+//  @Description: 获取错误类型，未使用Error包装的错误按服务端状态码及系统错误分类
+//  @param err
+//  @return ErrorKind 没有错误时为空
+//
+func KindOf(err error) ErrorKind {
+	if err == nil {
+		return ""
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	var es _errSt
+	if errors.As(err, &es) {
+		return statusKind(es.Code)
+	}
+	var ue *utcloud.Error
+	if errors.As(err, &ue) {
+		if ue.StatusCode != http.StatusOK {
+			return statusKind(ue.StatusCode)
+		}
+		return statusKind(ue.Code)
+	}
+	var se oss.ServiceError
+	if errors.As(err, &se) {
+		return ossKind(se)
+	}
+	var s3e *S3Error
+	if errors.As(err, &s3e) {
+		return statusKind(s3e.StatusCode)
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return KindCancelled
+	case errors.Is(err, context.DeadlineExceeded):
+		return KindNetworkUnavailable
+	case errors.Is(err, ErrJobNotFound):
+		return KindNotFound
+	case errors.Is(err, ErrJobFinished), errors.Is(err, ErrJobActive), errors.Is(err, ErrMD5Mismatch):
+		return KindConflict
+	case errors.Is(err, os.ErrNotExist):
+		return KindNotFound
+	case errors.Is(err, os.ErrPermission):
+		return KindPermissionDenied
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return KindQuotaExceeded
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return KindNetworkUnavailable
+	}
+	return KindFailed
+}
+
+//----------------------辅助函数------------------------
+
+//statusKind 按HTTP状态码分类
+func statusKind(status int) ErrorKind {
+	switch status {
+	case http.StatusBadRequest:
+		return KindInvalidArgument
+	case http.StatusUnauthorized:
+		return KindUnauthenticated
+	case http.StatusForbidden:
+		return KindPermissionDenied
+	case http.StatusNotFound:
+		return KindNotFound
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return KindConflict
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests, http.StatusInsufficientStorage:
+		return KindQuotaExceeded
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return KindNetworkUnavailable
+	}
+	return KindFailed
+}
+
+//ossKind oss错误优先按错误码分类
+func ossKind(se oss.ServiceError) ErrorKind {
+	switch se.Code {
+	case "NoSuchKey", "NoSuchBucket", "NoSuchUpload":
+		return KindNotFound
+	case "AccessDenied", "SignatureDoesNotMatch":
+		return KindPermissionDenied
+	case "InvalidDigest", "BadDigest", "InvalidArgument", "EntityTooSmall":
+		return KindInvalidArgument
+	case "EntityTooLarge", "QuotaExceeded", "TooManyBuckets":
+		return KindQuotaExceeded
+	}
+	return statusKind(se.StatusCode)
+}
+
+//ossMapError 将oss服务端错误转换为带类型的错误，保留错误码及RequestId
+func ossMapError(err error) error {
+	var se oss.ServiceError
+	if err == nil || !errors.As(err, &se) {
+		return err
+	}
+	if se.StatusCode == http.StatusNotFound {
+		return &Error{Kind: KindNotFound, Code: int32(se.StatusCode), Message: ErrNotExist.Message, Err: err}
+	}
+	return &Error{Kind: ossKind(se), Code: int32(se.StatusCode), Message: se.Error(), Err: err}
+}
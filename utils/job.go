@@ -0,0 +1,625 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	JobPending   = "pending"   //等待执行
+	JobRunning   = "running"   //正在执行
+	JobDone      = "done"      //执行成功
+	JobFailed    = "failed"    //执行失败
+	JobCancelled = "cancelled" //已取消
+)
+
+const (
+	JobUpload   = "upload"
+	JobDownload = "download"
+	JobSync     = "sync"
+	JobDelete   = "delete"
+)
+
+// Job 后台任务，状态变化时持久化到任务日志
+type Job struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"`
+	Key        string    `json:"key"`
+	LocalPath  string    `json:"local_path,omitempty"`
+	UID        uint32    `json:"uid"` //提交任务的用户，本地文件以该用户的权限访问
+	State      string    `json:"state"`
+	Result     string    `json:"result,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ErrorCode  int32     `json:"error_code,omitempty"`
+	ErrorKind  string    `json:"error_kind,omitempty"` //ErrorKind，与dbus错误名的后缀一致
+	Attempts   int       `json:"attempts"`
+	BytesDone  int64     `json:"bytes_done"`
+	BytesTotal int64     `json:"bytes_total"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Finished 任务是否已结束
+func (j *Job) Finished() bool {
+	return j.State == JobDone || j.State == JobFailed || j.State == JobCancelled
+}
+
+//JobInfo 任务信息，通过dbus导出的结构
+type JobInfo struct {
+	ID         string
+	Kind       string
+	Key        string
+	LocalPath  string
+	State      string
+	Result     string
+	Error      string
+	ErrorCode  int32
+	ErrorKind  string
+	Attempts   int32
+	BytesDone  uint64
+	BytesTotal uint64
+	CreatedAt  int64 //unix时间戳
+	UpdatedAt  int64
+	UID        uint32
+}
+
+// Info 转换为dbus导出的任务信息
+func (j *Job) Info() JobInfo {
+	return JobInfo{
+		ID:         j.ID,
+		Kind:       j.Kind,
+		Key:        j.Key,
+		LocalPath:  j.LocalPath,
+		State:      j.State,
+		Result:     j.Result,
+		Error:      j.Error,
+		ErrorCode:  j.ErrorCode,
+		ErrorKind:  j.ErrorKind,
+		Attempts:   int32(j.Attempts),
+		BytesDone:  uint64(j.BytesDone),
+		BytesTotal: uint64(j.BytesTotal),
+		CreatedAt:  j.CreatedAt.Unix(),
+		UpdatedAt:  j.UpdatedAt.Unix(),
+		UID:        j.UID,
+	}
+}
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobFinished = errors.New("job already finished")
+	ErrJobActive   = errors.New("job not finished")
+)
+
+//ProgressFunc 传输进度回调
+type ProgressFunc func(done, total int64)
+
+//JobHandler 执行任务，通过progress上报进度，返回任务结果
+type JobHandler func(ctx context.Context, job *Job, progress ProgressFunc) (string, error)
+
+const (
+	progressInterval = 500 * time.Millisecond //进度通知的最小间隔
+	offlineRetries   = 10                     //因网络不可用重新排队的最大次数
+	offlineDelay     = time.Second            //因网络不可用重新排队前的等待时间，之后每次翻倍
+	maxOfflineDelay  = time.Minute
+)
+
+//JobQueue 持久化的任务队列，任务日志保存在状态目录下，重启后继续执行未完成的任务
+type JobQueue struct {
+	mut        sync.Mutex
+	cond       *sync.Cond
+	file       string
+	workers    int
+	keep       int //保留的已结束任务数
+	jobs       map[string]*Job
+	order      []string //按提交顺序排列的任务ID
+	pending    []string
+	handlers   map[string]JobHandler
+	onChange   func(job Job)
+	onProgress func(job Job)
+	onOffline  func()
+	paused     bool                          //网络不可用时暂停执行排队的任务
+	running    map[string]context.CancelFunc //正在执行的任务，用于取消
+	lastSend   map[string]time.Time          //上次通知进度的时间
+	events     []Job                         //待通知的状态变化
+	notifying  bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	stopped    bool
+}
+
+//
+// NewJobQueue
+//  @Description: 创建任务队列并加载任务日志，上次退出时正在执行的任务重新排队
+//  @param file 任务日志文件
+//  @param workers 并发执行的任务数
+//  @param keep 保留的已结束任务数
+//  @return *JobQueue
+//  @return error
+//
+func NewJobQueue(file string, workers, keep int) (*JobQueue, error) {
+	if workers <= 0 {
+		return nil, errors.New("workers should be positive")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &JobQueue{
+		file:     file,
+		workers:  workers,
+		keep:     keep,
+		jobs:     map[string]*Job{},
+		handlers: map[string]JobHandler{},
+		running:  map[string]context.CancelFunc{},
+		lastSend: map[string]time.Time{},
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	q.cond = sync.NewCond(&q.mut)
+	if err := q.load(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Handle 注册任务处理函数，需要在Start之前调用
+func (q *JobQueue) Handle(kind string, handler JobHandler) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	q.handlers[kind] = handler
+}
+
+// OnChange 注册任务状态变化的回调，需要在Start之前调用
+func (q *JobQueue) OnChange(fn func(job Job)) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	q.onChange = fn
+}
+
+// OnProgress 注册任务进度变化的回调，需要在Start之前调用
+func (q *JobQueue) OnProgress(fn func(job Job)) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	q.onProgress = fn
+}
+
+// OnOffline 注册网络不可用回调，任务因网络不可用失败时重新排队并暂停队列，由回调检查网络后通过SetPaused恢复
+func (q *JobQueue) OnOffline(fn func()) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	q.onOffline = fn
+}
+
+// SetPaused 暂停或恢复执行排队的任务，正在执行的任务不受影响
+func (q *JobQueue) SetPaused(paused bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	if q.paused == paused {
+		return
+	}
+	q.paused = paused
+	if !paused {
+		q.cond.Broadcast()
+	}
+}
+
+// Start 启动工作协程
+func (q *JobQueue) Start() {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Stop 停止工作协程，正在执行的任务在下次启动时重新执行
+func (q *JobQueue) Stop() {
+	q.mut.Lock()
+	q.stopped = true
+	q.cancel()
+	q.cond.Broadcast()
+	q.mut.Unlock()
+	q.wg.Wait()
+}
+
+//
+// Submit
+//  @Description: 提交任务，持久化后立即返回
+//  @param kind 任务类型
+//  @param key 云端文件key
+//  @param localPath 本地文件路径
+//  @param uid 任务所属的用户
+//  @return Job
+//  @return error
+//
+func (q *JobQueue) Submit(kind, key, localPath string, uid uint32) (Job, error) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	if _, has := q.handlers[kind]; !has {
+		return Job{}, fmt.Errorf("unknown job kind %s", kind)
+	}
+	now := time.Now()
+	job := &Job{
+		ID:        NewID(),
+		Kind:      kind,
+		Key:       key,
+		LocalPath: localPath,
+		UID:       uid,
+		State:     JobPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	q.jobs[job.ID] = job
+	q.order = append(q.order, job.ID)
+	if err := q.save(); err != nil {
+		delete(q.jobs, job.ID)
+		q.order = q.order[:len(q.order)-1]
+		return Job{}, err
+	}
+	q.pending = append(q.pending, job.ID)
+	q.cond.Signal()
+	snapshot := *job
+	q.notify(snapshot)
+	return snapshot, nil
+}
+
+// Get 获取任务
+func (q *JobQueue) Get(id string) (Job, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	job, has := q.jobs[id]
+	if !has {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// List 按提交顺序获取所有任务
+func (q *JobQueue) List() []Job {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	list := make([]Job, 0, len(q.order))
+	for _, id := range q.order {
+		list = append(list, *q.jobs[id])
+	}
+	return list
+}
+
+//
+// Cancel
+//  @Description: 取消任务，正在执行的任务通过context中断传输
+//  @param id
+//  @return Job
+//  @return error
+//
+func (q *JobQueue) Cancel(id string) (Job, error) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	job, has := q.jobs[id]
+	if !has {
+		return Job{}, ErrJobNotFound
+	}
+	if job.Finished() {
+		return *job, ErrJobFinished
+	}
+	job.State = JobCancelled
+	job.UpdatedAt = time.Now()
+	if cancel, has := q.running[id]; has {
+		cancel()
+	}
+	q.saveLog()
+	snapshot := *job
+	q.notify(snapshot)
+	return snapshot, nil
+}
+
+//
+// Retry
+//  @Description: 重新执行失败或已取消的任务
+//  @param id
+//  @return Job
+//  @return error
+//
+func (q *JobQueue) Retry(id string) (Job, error) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	job, has := q.jobs[id]
+	if !has {
+		return Job{}, ErrJobNotFound
+	}
+	if job.State != JobFailed && job.State != JobCancelled {
+		return *job, ErrJobActive
+	}
+	if _, has := q.running[id]; has {
+		// 已取消但传输尚未中断
+		return *job, ErrJobActive
+	}
+	job.State = JobPending
+	job.Result = ""
+	job.Error = ""
+	job.ErrorCode = 0
+	job.ErrorKind = ""
+	job.BytesDone = 0
+	job.UpdatedAt = time.Now()
+	q.saveLog()
+	q.pending = append(q.pending, id)
+	q.cond.Signal()
+	snapshot := *job
+	q.notify(snapshot)
+	return snapshot, nil
+}
+
+//----------------------辅助函数------------------------
+
+func (q *JobQueue) work() {
+	defer q.wg.Done()
+	for {
+		q.mut.Lock()
+		for (len(q.pending) == 0 || q.paused) && !q.stopped {
+			q.cond.Wait()
+		}
+		if q.stopped {
+			q.mut.Unlock()
+			return
+		}
+		id := q.pending[0]
+		q.pending = q.pending[1:]
+		job, has := q.jobs[id]
+		if !has || job.State != JobPending {
+			q.mut.Unlock()
+			continue
+		}
+		handler := q.handlers[job.Kind]
+		// 任务以提交任务的用户的权限访问本地文件
+		ctx, cancel := context.WithCancel(WithOwner(WithJobBandwidth(q.ctx), job.UID))
+		q.running[id] = cancel
+		job.State = JobRunning
+		job.Attempts++
+		job.UpdatedAt = time.Now()
+		q.saveLog()
+		snapshot := *job
+		q.notify(snapshot)
+		q.mut.Unlock()
+
+		result, err := q.run(ctx, handler, &snapshot)
+
+		q.mut.Lock()
+		cancel()
+		delete(q.running, id)
+		if job.State == JobCancelled {
+			// 执行期间被取消，Cancel中已经持久化并通知
+			delete(q.lastSend, job.ID)
+			q.mut.Unlock()
+			continue
+		}
+		if q.stopped {
+			// 退出导致的中断，下次启动重新执行
+			job.State = JobPending
+		} else if deferred := (*DeferredError)(nil); errors.As(err, &deferred) {
+			// 不在允许执行的时段，到时间后重新排队，不计入执行次数
+			log.Infof("job %s %s %s", job.Kind, job.Key, deferred.Error())
+			job.State = JobPending
+			job.Attempts--
+			job.Error = deferred.Error()
+			job.ErrorCode = 0
+			job.ErrorKind = ""
+			q.requeueAt(id, deferred.Until, false)
+		} else if err != nil && q.onOffline != nil && KindOf(err) == KindNetworkUnavailable && job.Attempts < offlineRetries {
+			// 网络不可用，退避后重新排在队首，恢复联网后继续执行；服务端可达但传输持续失败时不会连续重试
+			delay := offlineBackoff(job.Attempts)
+			log.Warnf("job %s %s network unavailable:[%s], retry after %s", job.Kind, job.Key, err.Error(), delay)
+			job.State = JobPending
+			job.Error = err.Error()
+			job.ErrorCode = ErrorCode(err)
+			job.ErrorKind = string(KindOf(err))
+			q.requeueAt(id, time.Now().Add(delay), true)
+			q.paused = true
+			go q.onOffline()
+		} else if err != nil {
+			log.Errorf("job %s %s error:[%s]", job.Kind, job.Key, err.Error())
+			job.State = JobFailed
+			job.Error = err.Error()
+			job.ErrorCode = ErrorCode(err)
+			job.ErrorKind = string(KindOf(err))
+		} else {
+			job.State = JobDone
+			job.Result = result
+			job.Error = ""
+			job.ErrorCode = 0
+			job.ErrorKind = ""
+		}
+		job.UpdatedAt = time.Now()
+		delete(q.lastSend, job.ID)
+		snapshot = *job
+		q.trim()
+		q.saveLog()
+		if !q.stopped {
+			q.notify(snapshot)
+		}
+		q.mut.Unlock()
+	}
+}
+
+//requeueAt 到until后将仍在等待的任务重新排队，front为true时排在队首
+func (q *JobQueue) requeueAt(id string, until time.Time, front bool) {
+	time.AfterFunc(time.Until(until), func() {
+		q.mut.Lock()
+		defer q.mut.Unlock()
+		if job, has := q.jobs[id]; has && job.State == JobPending && !q.stopped {
+			if front {
+				q.pending = append([]string{id}, q.pending...)
+			} else {
+				q.pending = append(q.pending, id)
+			}
+			q.cond.Signal()
+		}
+	})
+}
+
+//offlineBackoff 第attempts次执行因网络不可用失败后重新排队前的等待时间
+func offlineBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	d := offlineDelay << uint(attempts-1)
+	if d <= 0 || d > maxOfflineDelay {
+		d = maxOfflineDelay
+	}
+	return d
+}
+
+//notify 通知任务状态变化，调用方需持有锁，回调在新协程中按顺序执行
+func (q *JobQueue) notify(job Job) {
+	if q.onChange == nil {
+		return
+	}
+	q.events = append(q.events, job)
+	if !q.notifying {
+		q.notifying = true
+		go q.dispatch()
+	}
+}
+
+//dispatch 依次执行状态变化回调，回调中可以调用队列的方法
+func (q *JobQueue) dispatch() {
+	for {
+		q.mut.Lock()
+		if len(q.events) == 0 {
+			q.notifying = false
+			q.mut.Unlock()
+			return
+		}
+		job := q.events[0]
+		q.events = q.events[1:]
+		onChange := q.onChange
+		q.mut.Unlock()
+		onChange(job)
+	}
+}
+
+//progress 更新任务进度，按progressInterval节流通知
+func (q *JobQueue) progress(id string, done, total int64) {
+	q.mut.Lock()
+	job, has := q.jobs[id]
+	if !has || job.State != JobRunning {
+		q.mut.Unlock()
+		return
+	}
+	job.BytesDone = done
+	job.BytesTotal = total
+	now := time.Now()
+	if now.Sub(q.lastSend[id]) < progressInterval && done != total {
+		q.mut.Unlock()
+		return
+	}
+	q.lastSend[id] = now
+	snapshot := *job
+	onProgress := q.onProgress
+	q.mut.Unlock()
+	if onProgress != nil {
+		onProgress(snapshot)
+	}
+}
+
+func (q *JobQueue) run(ctx context.Context, handler JobHandler, job *Job) (result string, err error) {
+	if handler == nil {
+		return "", fmt.Errorf("unknown job kind %s", job.Kind)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panic: %v", r)
+		}
+	}()
+	return handler(ctx, job, func(done, total int64) {
+		q.progress(job.ID, done, total)
+	})
+}
+
+//trim 只保留最近的keep个已结束任务，调用方需持有锁
+func (q *JobQueue) trim() {
+	finished := 0
+	for i := len(q.order) - 1; i >= 0; i-- {
+		if q.jobs[q.order[i]].Finished() {
+			finished++
+		}
+	}
+	if finished <= q.keep {
+		return
+	}
+	order := make([]string, 0, len(q.order))
+	for _, id := range q.order {
+		if finished > q.keep && q.jobs[id].Finished() {
+			delete(q.jobs, id)
+			finished--
+			continue
+		}
+		order = append(order, id)
+	}
+	q.order = order
+}
+
+//load 加载任务日志，调用方需持有锁
+func (q *JobQueue) load() error {
+	data, err := ioutil.ReadFile(q.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var jobs []*Job
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return fmt.Errorf("job journal %s corrupted: %v", q.file, err)
+	}
+	for _, job := range jobs {
+		if job.State == JobRunning {
+			job.State = JobPending
+		}
+		q.jobs[job.ID] = job
+		q.order = append(q.order, job.ID)
+		if job.State == JobPending {
+			q.pending = append(q.pending, job.ID)
+		}
+	}
+	if len(q.pending) != 0 {
+		log.Infof("resume %d unfinished jobs", len(q.pending))
+	}
+	return nil
+}
+
+//save 写入任务日志，调用方需持有锁
+func (q *JobQueue) save() error {
+	jobs := make([]*Job, 0, len(q.order))
+	for _, id := range q.order {
+		jobs = append(jobs, q.jobs[id])
+	}
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		return err
+	}
+	if err := MakeDir(filepath.Dir(q.file)); err != nil {
+		return err
+	}
+	return writeFileAtomic(q.file, data, 0600)
+}
+
+//saveLog 写入任务日志，失败时只记录日志
+func (q *JobQueue) saveLog() {
+	if err := q.save(); err != nil {
+		log.Errorf("save job journal error:[%s]", err.Error())
+	}
+}
+
+func NewID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
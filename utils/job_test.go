@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJobOfflineBackoff(t *testing.T) {
+	q, err := NewJobQueue(filepath.Join(t.TempDir(), "jobs.json"), 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var runs, probes int32
+	q.Handle(JobUpload, func(ctx context.Context, job *Job, progress ProgressFunc) (string, error) {
+		atomic.AddInt32(&runs, 1)
+		return "", ErrOffline
+	})
+	// 探测成功，队列立即恢复，但失败的任务要等退避结束才重新执行
+	q.OnOffline(func() {
+		atomic.AddInt32(&probes, 1)
+		q.SetPaused(false)
+	})
+	q.Start()
+	defer q.Stop()
+
+	job, err := q.Submit(JobUpload, "/tmp/a", "/tmp/a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(offlineDelay / 2)
+	if got := atomic.LoadInt32(&runs); got != 1 {
+		t.Fatalf("expect 1 run before backoff ends, got %d", got)
+	}
+	if got, _ := q.Get(job.ID); got.State != JobPending || got.ErrorKind != string(KindNetworkUnavailable) {
+		t.Fatalf("expect pending job with network error, got %+v", got)
+	}
+	if atomic.LoadInt32(&probes) != 1 {
+		t.Fatalf("expect network probed once, got %d", probes)
+	}
+	time.Sleep(offlineDelay)
+	if got := atomic.LoadInt32(&runs); got != 2 {
+		t.Fatalf("expect 2 runs after backoff, got %d", got)
+	}
+}
+
+func TestOfflineBackoffGrows(t *testing.T) {
+	prev := time.Duration(0)
+	for i := 1; i <= offlineRetries+5; i++ {
+		d := offlineBackoff(i)
+		if d < prev || d > maxOfflineDelay {
+			t.Fatalf("offlineBackoff(%d) = %s, previous %s", i, d, prev)
+		}
+		prev = d
+	}
+	if offlineBackoff(1) != offlineDelay || offlineBackoff(0) != offlineDelay {
+		t.Fatalf("unexpected first backoff %s", offlineBackoff(1))
+	}
+	if prev != maxOfflineDelay {
+		t.Fatalf("expect backoff capped at %s, got %s", maxOfflineDelay, prev)
+	}
+}
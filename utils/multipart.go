@@ -0,0 +1,281 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jibenliu/utMsgDaemon/utils/utcloud"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	minPartSize    = 100 << 10 //oss要求除最后一个分片外不小于100KB
+	maxPartSize    = 5 << 30
+	partRetries    = 3 //单个分片的重试次数
+	partRetryDelay = time.Second
+	checkpointDir  = "uploads"
+)
+
+//errMultipartUnsupported 服务端不支持分片上传授权，由调用方改为单次PUT上传
+var errMultipartUnsupported = errors.New("multipart upload unsupported")
+
+//uploadCheckpoint 分片上传断点，保存在状态目录下，文件变化或分片大小变化时失效
+type uploadCheckpoint struct {
+	Key       string         `json:"key"`
+	LocalFile string         `json:"local_file"`
+	Size      int64          `json:"size"`
+	ModTime   time.Time      `json:"mod_time"`
+	MD5       string         `json:"md5"`
+	PartSize  int64          `json:"part_size"`
+	UploadID  string         `json:"upload_id"`
+	Parts     map[int]string `json:"parts"` //已完成分片的ETag
+}
+
+//completeMultipartUpload 合并分片请求体
+type completeMultipartUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+//
+// multipartUpload
+//  @Description: 分片上传文件，每个分片完成后记录断点，中断后再次上传时跳过已完成的分片
+//  @param ctx 取消时中断上传，保留断点
+//  @param token
+//  @param key 云端文件key
+//  @param fName 本地文件路径
+//  @param md5sum 整个文件的md5
+//  @param progress 上传进度回调，可为nil
+//  @return error 服务端不支持分片上传时返回errMultipartUnsupported
+//
+func multipartUpload(ctx context.Context, token, key, fName, md5sum string, progress ProgressFunc) error {
+	cfg := Conf()
+	fd, err := openFile(ctx, fName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	cpFile := checkpointFile(cfg, fName)
+	cp := loadCheckpoint(cpFile)
+	if cp == nil || cp.Key != key || cp.LocalFile != fName || cp.Size != info.Size() || !cp.ModTime.Equal(info.ModTime()) ||
+		cp.MD5 != md5sum || cp.PartSize != cfg.Transfer.PartSize {
+		cp = &uploadCheckpoint{
+			Key:       key,
+			LocalFile: fName,
+			Size:      info.Size(),
+			ModTime:   info.ModTime(),
+			MD5:       md5sum,
+			PartSize:  cfg.Transfer.PartSize,
+			Parts:     map[int]string{},
+		}
+	}
+	count := int((cp.Size + cp.PartSize - 1) / cp.PartSize)
+	acl, err := requestMultipartACL(ctx, token, cp, count)
+	if err != nil {
+		return err
+	}
+	if acl.UploadID != cp.UploadID {
+		// 服务端的分片上传已过期，重新上传所有分片
+		if len(cp.UploadID) != 0 {
+			log.Warnf("multipart upload %s expired, restart", cp.UploadID)
+		}
+		cp.UploadID = acl.UploadID
+		cp.Parts = map[int]string{}
+	}
+	if err := saveJSON(cpFile, cp); err != nil {
+		return err
+	}
+
+	tracker := newPartTracker(cp.Size, progress)
+	var todo []int
+	for i := 1; i <= count; i++ {
+		if _, has := cp.Parts[i]; has {
+			tracker.update(i, partLength(cp, i))
+			continue
+		}
+		todo = append(todo, i)
+	}
+	err = runParts(ctx, todo, func(ctx context.Context, number int) (string, error) {
+		return uploadPart(ctx, acl.PartURLs[number-1], fd, cp, number, tracker)
+	}, func(number int, etag string) {
+		cp.Parts[number] = etag
+		if err := saveJSON(cpFile, cp); err != nil {
+			log.Warnf("save upload checkpoint error:[%s]", err.Error())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := completeMultipart(ctx, acl.CompleteURL, cp); err != nil {
+		return err
+	}
+	_ = os.Remove(cpFile)
+	return nil
+}
+
+//----------------------辅助函数------------------------
+
+//requestMultipartACL 申请分片上传的临时授权，服务端约定见utcloud.ACLMultipart：
+//服务端为upload_id下的每个分片签发一个PUT地址，请求时带上upload_id则为已有的分片上传重新签发地址；
+//服务端返回4xx或授权不完整时认为不支持分片上传，返回errMultipartUnsupported
+func requestMultipartACL(ctx context.Context, token string, cp *uploadCheckpoint, count int) (*utcloud.ACL, error) {
+	binPath, _ := GetRunPath()
+	acl, err := apiClient(token).GetACL(ctx, utcloud.ACLRequest{
+		BinPath:   binPath,
+		Key:       cp.Key,
+		Method:    utcloud.ACLMultipart,
+		MD5:       cp.MD5,
+		Size:      cp.Size,
+		PartSize:  cp.PartSize,
+		PartCount: count,
+		UploadID:  cp.UploadID,
+	})
+	if err != nil {
+		log.Errorf("multipart upload acl error:[%s]", err.Error())
+		var aerr *utcloud.Error
+		if errors.As(err, &aerr) && aerr.StatusCode >= 400 && aerr.StatusCode < 500 {
+			return nil, fmt.Errorf("%w: %v", errMultipartUnsupported, err)
+		}
+		return nil, err
+	}
+	if len(acl.UploadID) == 0 || len(acl.CompleteURL) == 0 || len(acl.PartURLs) != count {
+		return nil, fmt.Errorf("%w: invalid acl, expect %d part urls, got %d", errMultipartUnsupported, count, len(acl.PartURLs))
+	}
+	return acl, nil
+}
+
+//uploadPart 上传单个分片，失败时重试，返回分片的ETag
+func uploadPart(ctx context.Context, signUrl string, fd *os.File, cp *uploadCheckpoint, number int, tracker *partTracker) (string, error) {
+	offset := int64(number-1) * cp.PartSize
+	length := partLength(cp, number)
+	hash := md5.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(fd, offset, length)); err != nil {
+		return "", err
+	}
+	contentMD5 := base64.StdEncoding.EncodeToString(hash.Sum(nil))
+
+	var err error
+	for i := 0; i < partRetries; i++ {
+		if i != 0 {
+			log.Warnf("upload part %d of %s error:[%s], retry", number, cp.Key, err.Error())
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(partRetryDelay * time.Duration(i)):
+			}
+		}
+		var etag string
+		etag, err = putPart(ctx, signUrl, fd, offset, length, contentMD5, func(done, total int64) {
+			tracker.update(number, done)
+		})
+		if err == nil {
+			return etag, nil
+		}
+		tracker.update(number, 0)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+	}
+	return "", err
+}
+
+func putPart(ctx context.Context, signUrl string, fd *os.File, offset, length int64, contentMD5 string, progress ProgressFunc) (string, error) {
+	body := newTransferReader(ctx, TransferUpload, io.NewSectionReader(fd, offset, length), length, progress)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, signUrl, ioutil.NopCloser(body))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-MD5", contentMD5)
+	resp, err := s3Do(req)
+	if err != nil {
+		return "", s3MapError(err)
+	}
+	defer resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if len(etag) == 0 {
+		return "", errors.New("upload part without etag")
+	}
+	return etag, nil
+}
+
+//completeMultipart 按分片序号合并分片
+func completeMultipart(ctx context.Context, signUrl string, cp *uploadCheckpoint) error {
+	body := completeMultipartUpload{}
+	for number, etag := range cp.Parts {
+		body.Parts = append(body.Parts, completePart{PartNumber: number, ETag: etag})
+	}
+	sort.Slice(body.Parts, func(i, j int) bool {
+		return body.Parts[i].PartNumber < body.Parts[j].PartNumber
+	})
+	data, err := xml.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, signUrl, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := s3Do(req)
+	if err != nil {
+		log.Errorf("complete multipart upload error:[%s]", err.Error())
+		return s3MapError(err)
+	}
+	defer resp.Body.Close()
+	// 合并过程中出错时仍然返回200
+	reply, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if serr := s3ErrorInBody(resp.StatusCode, reply); serr != nil {
+		log.Errorf("complete multipart upload error:[%s]", serr.Error())
+		return s3MapError(serr)
+	}
+	return nil
+}
+
+func partLength(cp *uploadCheckpoint, number int) int64 {
+	offset := int64(number-1) * cp.PartSize
+	if cp.Size-offset < cp.PartSize {
+		return cp.Size - offset
+	}
+	return cp.PartSize
+}
+
+//checkpointFile 断点文件路径，按本地文件路径区分
+func checkpointFile(cfg *Config, fName string) string {
+	sum := sha256.Sum256([]byte(fName))
+	return cfg.StatePath(filepath.Join(checkpointDir, hex.EncodeToString(sum[:16])+".json"))
+}
+
+func loadCheckpoint(file string) *uploadCheckpoint {
+	cp := &uploadCheckpoint{}
+	if !loadJSON(file, cp) {
+		return nil
+	}
+	if cp.Parts == nil {
+		cp.Parts = map[int]string{}
+	}
+	return cp
+}
@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	nmService = "org.freedesktop.NetworkManager"
+	nmPath    = "/org/freedesktop/NetworkManager"
+
+	nmStateConnectedLocal = 50 //NM_STATE_CONNECTED_LOCAL，低于该值(0除外)时没有可用的网络连接
+)
+
+//NetworkMonitor 检测能否访问utcloud服务端：定期探测服务端，并监听NetworkManager的StateChanged信号，
+//NetworkManager报告断网时直接认为离线，网络变化时立即重新探测；NetworkManager不可用时只依赖探测；
+//storage.driver为local时不检测
+type NetworkMonitor struct {
+	mut       sync.Mutex
+	probing   sync.Mutex //Probe与定期探测不同时执行，避免状态变化回调乱序
+	online    bool
+	nmOffline bool
+	onChange  func(online bool)
+	check     chan struct{}
+	stop      chan struct{}
+	once      sync.Once
+}
+
+//
+// NewNetworkMonitor
+//  @Description: 创建网络状态检测，初始认为在线
+//  @param onChange 在线状态变化回调，在检测协程中执行
+//  @return *NetworkMonitor
+//
+func NewNetworkMonitor(onChange func(online bool)) *NetworkMonitor {
+	return &NetworkMonitor{
+		online:   true,
+		onChange: onChange,
+		check:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start 开始检测，系统总线或NetworkManager不可用时只定期探测
+func (m *NetworkMonitor) Start() {
+	bus := GetBus(BusSystem)
+	err := bus.OnConnect(m.watchNetworkManager)
+	if err == nil {
+		err = bus.Start()
+	}
+	if err != nil {
+		log.Warnf("watch NetworkManager error:[%s], probe %s only", err.Error(), Conf().Utcloud.Server)
+	}
+	go m.run()
+}
+
+// Online 当前是否在线
+func (m *NetworkMonitor) Online() bool {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.online
+}
+
+// Probe 立即重新探测并返回探测后是否在线，状态变化时同样回调
+func (m *NetworkMonitor) Probe() bool {
+	m.update()
+	return m.Online()
+}
+
+// Check 立即重新探测，不等待结果
+func (m *NetworkMonitor) Check() {
+	select {
+	case m.check <- struct{}{}:
+	default:
+	}
+}
+
+// Close 停止检测
+func (m *NetworkMonitor) Close() {
+	m.once.Do(func() {
+		close(m.stop)
+	})
+}
+
+//----------------------辅助函数------------------------
+
+func (m *NetworkMonitor) run() {
+	m.update()
+	ticker := time.NewTicker(Conf().Network.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		case <-m.check:
+		}
+		m.update()
+	}
+}
+
+//update 重新检测，状态变化时回调
+func (m *NetworkMonitor) update() {
+	m.probing.Lock()
+	defer m.probing.Unlock()
+	m.mut.Lock()
+	online := !m.nmOffline
+	m.mut.Unlock()
+	if Conf().Storage.Driver == StorageLocal {
+		// local存储不经过网络，始终认为在线，用于离线测试
+		online = true
+	} else if online {
+		online = probeServer()
+	}
+
+	m.mut.Lock()
+	changed := m.online != online
+	m.online = online
+	m.mut.Unlock()
+	if !changed {
+		return
+	}
+	if online {
+		log.Infof("network online")
+	} else {
+		log.Warnf("network offline")
+	}
+	if m.onChange != nil {
+		m.onChange(online)
+	}
+}
+
+//probeServer 探测utcloud服务端，收到任何http响应都认为在线
+func probeServer() bool {
+	cfg := Conf()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Network.ProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, cfg.Utcloud.Server, nil)
+	if err != nil {
+		log.Errorf("probe %s error:[%s]", cfg.Utcloud.Server, err.Error())
+		return false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Debugf("probe %s error:[%s]", cfg.Utcloud.Server, err.Error())
+		return false
+	}
+	_ = resp.Body.Close()
+	return true
+}
+
+//watchNetworkManager 监听NetworkManager的StateChanged信号，总线重连后由BusManager重新执行
+func (m *NetworkMonitor) watchNetworkManager(conn *dbus.Conn) error {
+	err := conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(nmPath),
+		dbus.WithMatchInterface(nmService),
+		dbus.WithMatchMember("StateChanged"),
+	)
+	if err != nil {
+		return err
+	}
+	ch := make(chan *dbus.Signal, 10)
+	conn.Signal(ch)
+	go func() {
+		// NetworkManager可能未运行，此时只依赖探测
+		if v, err := conn.Object(nmService, nmPath).GetProperty(nmService + ".State"); err == nil {
+			if state, ok := v.Value().(uint32); ok {
+				m.setNMState(state)
+			}
+		} else {
+			log.Debugf("get NetworkManager state error:[%s]", err.Error())
+		}
+		// 连接关闭后godbus会关闭ch
+		for sig := range ch {
+			if sig.Path != nmPath || sig.Name != nmService+".StateChanged" || len(sig.Body) < 1 {
+				continue
+			}
+			if state, ok := sig.Body[0].(uint32); ok {
+				m.setNMState(state)
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *NetworkMonitor) setNMState(state uint32) {
+	log.Debugf("NetworkManager state %d", state)
+	m.mut.Lock()
+	m.nmOffline = state != 0 && state < nmStateConnectedLocal
+	m.mut.Unlock()
+	m.Check()
+}
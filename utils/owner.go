@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+type ownerKey struct{}
+
+//
+// WithOwner
+//  @Description: 设置访问本地文件的用户，守护进程以root运行时按该用户的权限打开、创建及删除本地文件，
+//  用户不能借助守护进程读取或覆盖自己无权访问的文件，创建的文件也直接属于该用户
+//  @param ctx
+//  @param uid 为0时以守护进程自己的权限访问，用于状态目录、local存储根目录等守护进程自己的文件
+//  @return context.Context
+//
+func WithOwner(ctx context.Context, uid uint32) context.Context {
+	return context.WithValue(ctx, ownerKey{}, uid)
+}
+
+//
+// CheckReadFile
+//  @Description: 检查uid能否读取普通文件v，root不做限制
+//  @param v 文件路径，需要是绝对路径
+//  @param uid
+//  @return error
+//
+func CheckReadFile(v string, uid uint32) error {
+	if len(v) == 0 {
+		return ErrInvalidParam
+	}
+	if !filepath.IsAbs(v) {
+		return &Error{Kind: KindInvalidArgument, Code: -1, Message: "path should be absolute"}
+	}
+	_, err := FileSize(WithOwner(context.Background(), uid), v)
+	if os.IsPermission(err) {
+		return ErrPermission
+	} else if os.IsNotExist(err) {
+		return ErrNoFile
+	}
+	return err
+}
+
+//----------------------辅助函数------------------------
+
+//withoutOwner 访问守护进程自己的文件时使用，不切换用户
+func withoutOwner(ctx context.Context) context.Context {
+	return WithOwner(ctx, 0)
+}
+
+//
+// asOwner
+//  @Description: 以ctx中设置的用户的文件系统权限(fsuid、fsgid及附属组)执行fn，只影响当前线程，
+//  执行期间锁定线程，fn中不能启动需要相同权限的协程；没有设置用户、用户为root或守护进程不是root时直接执行
+//  @param ctx
+//  @param fn 只执行路径相关的系统调用，已打开的文件在恢复权限后仍可读写
+//  @return error
+//
+func asOwner(ctx context.Context, fn func() error) error {
+	uid, _ := ctx.Value(ownerKey{}).(uint32)
+	if uid == 0 || os.Geteuid() != 0 {
+		return fn()
+	}
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		log.Errorf("lookup user %d error:[%s]", uid, err.Error())
+		return ErrPermission
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return ErrPermission
+	}
+	var groups []int
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if g, err := strconv.Atoi(id); err == nil {
+				groups = append(groups, g)
+			}
+		}
+	}
+
+	runtime.LockOSThread()
+	oldGroups, err := unix.Getgroups()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	// x/sys/unix的Setgroups、Setfsuid只作用于当前线程
+	if err := unix.Setgroups(groups); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	unix.SetfsgidRetGid(gid)
+	unix.SetfsuidRetUid(int(uid))
+	defer func() {
+		unix.SetfsuidRetUid(0)
+		unix.SetfsgidRetGid(0)
+		gerr := unix.Setgroups(oldGroups)
+		// 参数非法时setfsuid不修改并返回当前值
+		if cur, _ := unix.SetfsuidRetUid(-1); cur != 0 || gerr != nil {
+			// 无法恢复时不解锁，协程结束后线程随之退出，不会被其他协程使用
+			log.Errorf("restore file system user of thread failed, fsuid %d", cur)
+			return
+		}
+		runtime.UnlockOSThread()
+	}()
+	if cur, _ := unix.SetfsuidRetUid(-1); cur != int(uid) {
+		return fmt.Errorf("switch file system user to %d failed", uid)
+	}
+	return fn()
+}
+
+//openFile 以ctx中设置的用户的权限打开文件
+func openFile(ctx context.Context, name string, flag int, perm os.FileMode) (*os.File, error) {
+	var fd *os.File
+	err := asOwner(ctx, func() error {
+		var err error
+		fd, err = os.OpenFile(name, flag, perm)
+		return err
+	})
+	return fd, err
+}
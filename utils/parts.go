@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"context"
+	"sync"
+)
+
+//
+// runParts
+//  @Description: 按transfer.parallel并发处理分片，一个分片失败时取消其他分片，分段下载与分片上传共用
+//  @param ctx 取消时中断所有分片
+//  @param numbers 需要处理的分片序号
+//  @param fn 处理单个分片，返回的result传给onDone
+//  @param onDone 分片完成后回调，回调之间互斥，用于记录断点
+//  @return error ctx取消时返回ctx.Err()，否则返回第一个失败分片的错误
+//
+func runParts(ctx context.Context, numbers []int, fn func(ctx context.Context, number int) (string, error), onDone func(number int, result string)) error {
+	var (
+		mut      sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	partsCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	todo := make(chan int, len(numbers))
+	for _, number := range numbers {
+		todo <- number
+	}
+	close(todo)
+	for i := 0; i < Conf().Transfer.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for number := range todo {
+				if partsCtx.Err() != nil {
+					return
+				}
+				result, err := fn(partsCtx, number)
+				mut.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					mut.Unlock()
+					cancel()
+					return
+				}
+				onDone(number, result)
+				mut.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+//partTracker 汇总各分片的进度
+type partTracker struct {
+	mut      sync.Mutex
+	parts    map[int]int64
+	total    int64
+	progress ProgressFunc
+}
+
+func newPartTracker(total int64, progress ProgressFunc) *partTracker {
+	return &partTracker{parts: map[int]int64{}, total: total, progress: progress}
+}
+
+func (t *partTracker) update(number int, done int64) {
+	if t.progress == nil {
+		return
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.parts[number] = done
+	var sum int64
+	for _, item := range t.parts {
+		sum += item
+	}
+	// 持有锁回调，保证上报的进度有序
+	t.progress(sum, t.total)
+}
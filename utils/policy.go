@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ErrAccessDenied = "org.freedesktop.DBus.Error.AccessDenied"
+	defaultAuthRule = "default"
+)
+
+//ActionChecker 检查调用方是否获得指定action的授权(如polkit)
+type ActionChecker interface {
+	CheckAction(caller *Caller, action string) (bool, error)
+}
+
+//Authorizer 导出方法的调用方鉴权
+type Authorizer struct {
+	resolver SenderResolver
+	checker  ActionChecker
+	config   func() AuthConfig
+}
+
+//
+// NewAuthorizer
+//  @Description: 创建调用方鉴权器，鉴权规则每次调用时从当前配置读取，支持热更新
+//  @param resolver 调用方信息查询
+//  @param checker 规则中配置了polkit_action时使用，为nil时配置了action的方法一律拒绝
+//  @return *Authorizer
+//
+func NewAuthorizer(resolver SenderResolver, checker ActionChecker) *Authorizer {
+	return &Authorizer{
+		resolver: resolver,
+		checker:  checker,
+		config: func() AuthConfig {
+			return Conf().Auth
+		},
+	}
+}
+
+//
+// Authorize
+//  @Description: 方法执行前检查调用方是否有权限
+//  @param sender dbus sender
+//  @param method 被调用的方法名
+//  @return *Caller 调用方信息
+//  @return *dbus.Error 无权限时返回org.freedesktop.DBus.Error.AccessDenied
+//
+func (a *Authorizer) Authorize(sender, method string) (*Caller, *dbus.Error) {
+	caller, err := a.resolver.Resolve(sender)
+	if err != nil {
+		log.Errorf("resolve sender %s error:[%s]", sender, err.Error())
+		return nil, accessDenied(fmt.Sprintf("cannot identify caller: %s", err.Error()))
+	}
+	cfg := a.config()
+	if !cfg.Enabled {
+		return caller, nil
+	}
+	rule := lookupRule(cfg.Rules, method)
+	if !rule.allow(caller) {
+		log.WithFields(log.Fields{
+			"path":   caller.Exe,
+			"uid":    caller.UID,
+			"method": method,
+		}).Warn("caller not in allowlist")
+		return nil, accessDenied(fmt.Sprintf("%s is not allowed to call %s", caller.Exe, method))
+	}
+	action := rule.PolkitAction
+	if len(action) == 0 && cfg.Polkit && Conf().Service.Bus == BusSystem {
+		action = PolkitActionID(Conf().Service.Name, method)
+	}
+	if len(action) == 0 {
+		return caller, nil
+	}
+	if a.checker == nil {
+		return nil, accessDenied("authorization checker unavailable")
+	}
+	ok, err := a.checker.CheckAction(caller, action)
+	if errors.Is(err, errActionNotRegistered) && len(rule.PolkitAction) == 0 {
+		// 内置action在旧版本安装的.policy中不存在，重新install之前只允许root调用
+		log.Warnf("polkit action %s not registered, reinstall the service to update the policy", action)
+		if caller.UID == 0 {
+			return caller, nil
+		}
+		return nil, accessDenied(fmt.Sprintf("polkit action %s not registered, only root is allowed", action))
+	}
+	if err != nil {
+		log.Errorf("check action %s error:[%s]", action, err.Error())
+		return nil, accessDenied(fmt.Sprintf("check authorization %s error: %s", action, err.Error()))
+	}
+	if !ok {
+		return nil, accessDenied(fmt.Sprintf("not authorized for %s", action))
+	}
+	return caller, nil
+}
+
+//----------------------辅助函数------------------------
+func lookupRule(rules map[string]AuthRule, method string) AuthRule {
+	// viper读取的map key均为小写
+	for key, rule := range rules {
+		if strings.EqualFold(key, method) {
+			return rule
+		}
+	}
+	return rules[defaultAuthRule]
+}
+
+//allow 调用方可执行文件在paths中或用户在uids中即允许，两者都未配置时不限制
+func (r AuthRule) allow(caller *Caller) bool {
+	if len(r.Paths) == 0 && len(r.UIDs) == 0 {
+		return true
+	}
+	for _, item := range r.Paths {
+		if ok, _ := filepath.Match(item, caller.Exe); ok {
+			return true
+		}
+	}
+	for _, item := range r.UIDs {
+		if item == caller.UID {
+			return true
+		}
+	}
+	return false
+}
+
+func accessDenied(msg string) *dbus.Error {
+	return dbus.NewError(ErrAccessDenied, []interface{}{msg})
+}
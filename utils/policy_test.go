@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+type fakeResolver struct {
+	caller *Caller
+	err    error
+}
+
+func (f fakeResolver) Resolve(sender string) (*Caller, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	c := *f.caller
+	c.Sender = sender
+	return &c, nil
+}
+
+type fakeChecker struct {
+	allow   bool
+	err     error
+	actions []string
+}
+
+func (f *fakeChecker) CheckAction(caller *Caller, action string) (bool, error) {
+	f.actions = append(f.actions, action)
+	return f.allow, f.err
+}
+
+func TestAuthorize(t *testing.T) {
+	app := &Caller{PID: 100, UID: 1000, Exe: "/usr/bin/app"}
+	other := &Caller{PID: 200, UID: 1001, Exe: "/usr/bin/other"}
+	cases := []struct {
+		name    string
+		cfg     AuthConfig
+		bus     string
+		caller  *Caller
+		resolve error
+		checker *fakeChecker
+		method  string
+		allowed bool
+		action  string //期望检查的polkit action
+	}{
+		{
+			name:    "disabled allows everyone",
+			cfg:     AuthConfig{Enabled: false, Rules: map[string]AuthRule{"upload": {UIDs: []uint32{0}}}},
+			caller:  other,
+			method:  "Upload",
+			allowed: true,
+		},
+		{
+			name:    "no rule allows everyone",
+			cfg:     AuthConfig{Enabled: true},
+			caller:  other,
+			method:  "Upload",
+			allowed: true,
+		},
+		{
+			name:    "path glob allowed",
+			cfg:     AuthConfig{Enabled: true, Rules: map[string]AuthRule{"upload": {Paths: []string{"/usr/bin/a*"}}}},
+			caller:  app,
+			method:  "Upload",
+			allowed: true,
+		},
+		{
+			name:   "path glob denied",
+			cfg:    AuthConfig{Enabled: true, Rules: map[string]AuthRule{"upload": {Paths: []string{"/usr/bin/a*"}}}},
+			caller: other,
+			method: "Upload",
+		},
+		{
+			name:    "uid allowed",
+			cfg:     AuthConfig{Enabled: true, Rules: map[string]AuthRule{"upload": {Paths: []string{"/opt/*"}, UIDs: []uint32{1001}}}},
+			caller:  other,
+			method:  "Upload",
+			allowed: true,
+		},
+		{
+			name:   "uid denied",
+			cfg:    AuthConfig{Enabled: true, Rules: map[string]AuthRule{"upload": {UIDs: []uint32{1001}}}},
+			caller: app,
+			method: "Upload",
+		},
+		{
+			name:   "default rule for unlisted method",
+			cfg:    AuthConfig{Enabled: true, Rules: map[string]AuthRule{"default": {UIDs: []uint32{1000}}, "upload": {}}},
+			caller: other,
+			method: "Delete",
+		},
+		{
+			name:    "method rule overrides default",
+			cfg:     AuthConfig{Enabled: true, Rules: map[string]AuthRule{"default": {UIDs: []uint32{1000}}, "upload": {}}},
+			caller:  other,
+			method:  "Upload",
+			allowed: true,
+		},
+		{
+			name:    "method key case insensitive",
+			cfg:     AuthConfig{Enabled: true, Rules: map[string]AuthRule{"UPLOADMANY": {UIDs: []uint32{1000}}}},
+			caller:  app,
+			method:  "UploadMany",
+			allowed: true,
+		},
+		{
+			name:   "method key case insensitive denied",
+			cfg:    AuthConfig{Enabled: true, Rules: map[string]AuthRule{"uploadmany": {UIDs: []uint32{1000}}}},
+			caller: other,
+			method: "UploadMany",
+		},
+		{
+			name:    "resolver error denied",
+			cfg:     AuthConfig{Enabled: false},
+			resolve: errors.New("no such name"),
+			method:  "Upload",
+		},
+		{
+			name:    "rule polkit action allowed",
+			cfg:     AuthConfig{Enabled: true, Rules: map[string]AuthRule{"upload": {PolkitAction: "com.example.upload"}}},
+			caller:  app,
+			checker: &fakeChecker{allow: true},
+			method:  "Upload",
+			allowed: true,
+			action:  "com.example.upload",
+		},
+		{
+			name:    "rule polkit action denied",
+			cfg:     AuthConfig{Enabled: true, Rules: map[string]AuthRule{"upload": {PolkitAction: "com.example.upload"}}},
+			caller:  app,
+			checker: &fakeChecker{allow: false},
+			method:  "Upload",
+			action:  "com.example.upload",
+		},
+		{
+			name:    "polkit error denied",
+			cfg:     AuthConfig{Enabled: true, Rules: map[string]AuthRule{"upload": {PolkitAction: "com.example.upload"}}},
+			caller:  app,
+			checker: &fakeChecker{allow: true, err: errors.New("polkit unavailable")},
+			method:  "Upload",
+			action:  "com.example.upload",
+		},
+		{
+			name:   "polkit action without checker denied",
+			cfg:    AuthConfig{Enabled: true, Rules: map[string]AuthRule{"upload": {PolkitAction: "com.example.upload"}}},
+			caller: app,
+			method: "Upload",
+		},
+		{
+			name:    "system bus builtin action",
+			cfg:     AuthConfig{Enabled: true, Polkit: true},
+			bus:     BusSystem,
+			caller:  app,
+			checker: &fakeChecker{allow: true},
+			method:  "SetToken",
+			allowed: true,
+			action:  PolkitActionID(DefaultConfig().Service.Name, "SetToken"),
+		},
+		{
+			name:    "session bus skips builtin action",
+			cfg:     AuthConfig{Enabled: true, Polkit: true},
+			bus:     BusSession,
+			caller:  app,
+			checker: &fakeChecker{allow: false},
+			method:  "SetToken",
+			allowed: true,
+		},
+		{
+			name:    "builtin action not registered allows root",
+			cfg:     AuthConfig{Enabled: true, Polkit: true},
+			bus:     BusSystem,
+			caller:  &Caller{PID: 1, UID: 0, Exe: "/usr/bin/root"},
+			checker: &fakeChecker{err: errActionNotRegistered},
+			method:  "SetBandwidthLimit",
+			allowed: true,
+			action:  PolkitActionID(DefaultConfig().Service.Name, "SetBandwidthLimit"),
+		},
+		{
+			name:    "builtin action not registered denies others",
+			cfg:     AuthConfig{Enabled: true, Polkit: true},
+			bus:     BusSystem,
+			caller:  app,
+			checker: &fakeChecker{err: errActionNotRegistered},
+			method:  "SetBandwidthLimit",
+			action:  PolkitActionID(DefaultConfig().Service.Name, "SetBandwidthLimit"),
+		},
+		{
+			name:    "rule action not registered denies root",
+			cfg:     AuthConfig{Enabled: true, Rules: map[string]AuthRule{"upload": {PolkitAction: "com.example.upload"}}},
+			caller:  &Caller{PID: 1, UID: 0, Exe: "/usr/bin/root"},
+			checker: &fakeChecker{err: errActionNotRegistered},
+			method:  "Upload",
+			action:  "com.example.upload",
+		},
+	}
+
+	if PolkitActionID(DefaultConfig().Service.Name, "SetToken") == "" {
+		t.Fatal("SetToken should have a builtin polkit action")
+	}
+	defer SetConf(Conf())
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			if len(tc.bus) != 0 {
+				c.Service.Bus = tc.bus
+			}
+			SetConf(c)
+			cfg := tc.cfg
+			a := &Authorizer{
+				resolver: fakeResolver{caller: tc.caller, err: tc.resolve},
+				config:   func() AuthConfig { return cfg },
+			}
+			if tc.checker != nil {
+				a.checker = tc.checker
+			}
+			caller, derr := a.Authorize(":1.10", tc.method)
+			if tc.allowed {
+				if derr != nil {
+					t.Fatalf("expect allowed, got %v", derr)
+				}
+				if caller == nil || caller.Sender != ":1.10" || caller.UID != tc.caller.UID {
+					t.Fatalf("unexpected caller %+v", caller)
+				}
+			} else {
+				if derr == nil {
+					t.Fatal("expect denied")
+				}
+				if derr.Name != ErrAccessDenied {
+					t.Fatalf("expect %s, got %s", ErrAccessDenied, derr.Name)
+				}
+			}
+			if tc.checker != nil {
+				var got string
+				if len(tc.checker.actions) != 0 {
+					got = tc.checker.actions[0]
+				}
+				if got != tc.action {
+					t.Fatalf("expect action %q checked, got %q", tc.action, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	polkitService   = "org.freedesktop.PolicyKit1"
+	polkitPath      = "/org/freedesktop/PolicyKit1/Authority"
+	polkitInterface = "org.freedesktop.PolicyKit1.Authority"
+
+	polkitErrorFailed = "org.freedesktop.PolicyKit1.Error.Failed"
+
+	polkitAllowUserInteraction uint32 = 1
+	polkitTimeout                     = 2 * time.Minute //交互式授权需要等待用户输入密码
+)
+
+//errActionNotRegistered polkit中没有注册该action，通常是升级后没有重新安装服务生成.policy文件
+var errActionNotRegistered = errors.New("polkit action not registered")
+
+// PolkitAction 需要polkit授权的方法
+type PolkitAction struct {
+	Method      string
+	Suffix      string //action id后缀，完整id为服务名.后缀
+	Description string
+	Message     string
+}
+
+// polkitActions system总线模式下默认需要polkit授权的方法，新增的方法需要重新执行install生成.policy文件，
+// 之前安装的.policy中没有对应action时只允许root调用
+var polkitActions = []PolkitAction{
+	{
+		Method:      "AddWhitelist",
+		Suffix:      "add-whitelist",
+		Description: "Register this machine and application with utcloud",
+		Message:     "Authentication is required to add this machine to the utcloud whitelist",
+	},
+	{
+		Method:      "SetToken",
+		Suffix:      "set-token",
+		Description: "Set the utcloud token used by the daemon",
+		Message:     "Authentication is required to set the utcloud token",
+	},
+	{
+		Method:      "SetBandwidthLimit",
+		Suffix:      "set-bandwidth-limit",
+		Description: "Limit the transfer bandwidth of the daemon",
+		Message:     "Authentication is required to change the transfer bandwidth limit",
+	},
+}
+
+// PolkitActions 获取默认需要polkit授权的方法
+func PolkitActions() []PolkitAction {
+	return polkitActions
+}
+
+// PolkitActionID 获取方法对应的action id，不需要授权时返回空
+func PolkitActionID(serviceName, method string) string {
+	for _, item := range polkitActions {
+		if item.Method == method {
+			return serviceName + "." + item.Suffix
+		}
+	}
+	return ""
+}
+
+type polkitSubject struct {
+	Kind    string
+	Details map[string]dbus.Variant
+}
+
+type polkitResult struct {
+	IsAuthorized bool
+	IsChallenge  bool
+	Details      map[string]string
+}
+
+//PolkitChecker 通过org.freedesktop.PolicyKit1.Authority.CheckAuthorization检查授权
+type PolkitChecker struct {
+	conn func() (*dbus.Conn, error)
+}
+
+//
+// NewPolkitChecker
+//  @Description: 创建polkit授权检查
+//  @param conn 获取polkit所在总线连接，为nil时使用system总线
+//  @return *PolkitChecker
+//
+func NewPolkitChecker(conn func() (*dbus.Conn, error)) *PolkitChecker {
+	if conn == nil {
+		conn = GetBus(BusSystem).Conn
+	}
+	return &PolkitChecker{conn: conn}
+}
+
+//
+// CheckAction
+//  @Description: 检查调用方是否获得action授权，允许交互式授权，已缓存的授权直接通过
+//  @param caller
+//  @param action
+//  @return bool
+//  @return error
+//
+func (p *PolkitChecker) CheckAction(caller *Caller, action string) (bool, error) {
+	conn, err := p.conn()
+	if err != nil {
+		return false, err
+	}
+	subject, err := newPolkitSubject(caller)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), polkitTimeout)
+	defer cancel()
+	var result polkitResult
+	err = conn.Object(polkitService, polkitPath).CallWithContext(ctx, polkitInterface+".CheckAuthorization", 0,
+		subject, action, map[string]string{}, polkitAllowUserInteraction, "").Store(&result)
+	if err != nil {
+		// polkitd对未注册的action返回Error.Failed: Action xxx is not registered
+		var derr dbus.Error
+		if errors.As(err, &derr) && derr.Name == polkitErrorFailed && strings.Contains(err.Error(), "not registered") {
+			return false, fmt.Errorf("%w: %s", errActionNotRegistered, action)
+		}
+		return false, err
+	}
+	log.Debugf("polkit check %s for %s result:[%#v]", action, caller.Exe, result)
+	return result.IsAuthorized, nil
+}
+
+//newPolkitSubject system总线上使用调用方总线名，session总线上使用调用方进程
+func newPolkitSubject(caller *Caller) (polkitSubject, error) {
+	if Conf().Service.Bus == BusSystem {
+		return polkitSubject{
+			Kind:    "system-bus-name",
+			Details: map[string]dbus.Variant{"name": dbus.MakeVariant(caller.Sender)},
+		}, nil
+	}
+	startTime, err := processStartTime(caller.PID)
+	if err != nil {
+		return polkitSubject{}, err
+	}
+	return polkitSubject{
+		Kind: "unix-process",
+		Details: map[string]dbus.Variant{
+			"pid":        dbus.MakeVariant(caller.PID),
+			"start-time": dbus.MakeVariant(startTime),
+			"uid":        dbus.MakeVariant(int32(caller.UID)),
+		},
+	}, nil
+}
+
+//processStartTime 读取/proc/pid/stat中的进程启动时间
+func processStartTime(pid uint32) (uint64, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// 进程名中可能包含空格，从最后一个')'之后开始解析
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, errors.New("invalid process stat")
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	// starttime为第22个字段，')'之后从第3个字段开始
+	if len(fields) < 20 {
+		return 0, errors.New("invalid process stat")
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
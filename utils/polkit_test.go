@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+//fakeAuthority 模拟org.freedesktop.PolicyKit1.Authority，action为allowed时授权
+type fakeAuthority struct {
+	mu      sync.Mutex
+	subject polkitSubject
+	action  string
+	flags   uint32
+}
+
+func (f *fakeAuthority) CheckAuthorization(subject polkitSubject, action string, details map[string]string,
+	flags uint32, cancel string) (polkitResult, *dbus.Error) {
+	f.mu.Lock()
+	f.subject, f.action, f.flags = subject, action, flags
+	f.mu.Unlock()
+	switch action {
+	case "com.example.unregistered":
+		return polkitResult{}, dbus.NewError(polkitErrorFailed, []interface{}{"Action " + action + " is not registered"})
+	case "com.example.allowed":
+		return polkitResult{IsAuthorized: true, Details: map[string]string{}}, nil
+	}
+	return polkitResult{Details: map[string]string{}}, nil
+}
+
+func (f *fakeAuthority) last() (polkitSubject, string, uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.subject, f.action, f.flags
+}
+
+//startPrivateBus 启动私有dbus-daemon，返回总线地址
+func startPrivateBus(t *testing.T) string {
+	bin, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+	cmd := exec.Command(bin, "--session", "--nofork", "--print-address=1", "--address=unix:tmpdir="+t.TempDir())
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read bus address error: %v", err)
+	}
+	return strings.TrimSpace(addr)
+}
+
+func connectBus(t *testing.T, addr string) *dbus.Conn {
+	conn, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestPolkitCheckAction(t *testing.T) {
+	addr := startPrivateBus(t)
+	authority := &fakeAuthority{}
+	server := connectBus(t, addr)
+	if err := server.Export(authority, polkitPath, polkitInterface); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := server.RequestName(polkitService, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("request name %s failed: %v", polkitService, err)
+	}
+	client := connectBus(t, addr)
+	checker := NewPolkitChecker(func() (*dbus.Conn, error) { return client, nil })
+
+	startTime, err := processStartTime(uint32(os.Getpid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller := &Caller{Sender: ":1.42", PID: uint32(os.Getpid()), UID: 1000, Exe: "/usr/bin/app"}
+	cases := []struct {
+		name    string
+		bus     string
+		action  string
+		allowed bool
+		err     error
+	}{
+		{name: "system bus allowed", bus: BusSystem, action: "com.example.allowed", allowed: true},
+		{name: "system bus denied", bus: BusSystem, action: "com.example.denied"},
+		{name: "session bus allowed", bus: BusSession, action: "com.example.allowed", allowed: true},
+		{name: "session bus denied", bus: BusSession, action: "com.example.denied"},
+		{name: "not registered", bus: BusSystem, action: "com.example.unregistered", err: errActionNotRegistered},
+	}
+
+	defer SetConf(Conf())
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.Service.Bus = tc.bus
+			SetConf(c)
+			ok, err := checker.CheckAction(caller, tc.action)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("expect error %v, got %v", tc.err, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.allowed {
+				t.Fatalf("expect allowed %v, got %v", tc.allowed, ok)
+			}
+
+			subject, action, flags := authority.last()
+			if action != tc.action {
+				t.Fatalf("expect action %s, got %s", tc.action, action)
+			}
+			if flags != polkitAllowUserInteraction {
+				t.Fatalf("expect flags %d, got %d", polkitAllowUserInteraction, flags)
+			}
+			if tc.bus == BusSystem {
+				if subject.Kind != "system-bus-name" {
+					t.Fatalf("expect system-bus-name subject, got %s", subject.Kind)
+				}
+				if name, _ := subject.Details["name"].Value().(string); name != caller.Sender {
+					t.Fatalf("expect name %s, got %v", caller.Sender, subject.Details["name"])
+				}
+				return
+			}
+			if subject.Kind != "unix-process" {
+				t.Fatalf("expect unix-process subject, got %s", subject.Kind)
+			}
+			if pid, _ := subject.Details["pid"].Value().(uint32); pid != caller.PID {
+				t.Fatalf("expect pid %d, got %v", caller.PID, subject.Details["pid"])
+			}
+			if st, _ := subject.Details["start-time"].Value().(uint64); st != startTime {
+				t.Fatalf("expect start-time %d, got %v", startTime, subject.Details["start-time"])
+			}
+			if uid, _ := subject.Details["uid"].Value().(int32); uid != int32(caller.UID) {
+				t.Fatalf("expect uid %d, got %v", caller.UID, subject.Details["uid"])
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"errors"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	secretService           = "org.freedesktop.secrets"
+	secretPath              = "/org/freedesktop/secrets"
+	secretServiceInterface  = "org.freedesktop.Secret.Service"
+	secretCollectionIface   = "org.freedesktop.Secret.Collection"
+	secretItemInterface     = "org.freedesktop.Secret.Item"
+	secretDefaultCollection = "/org/freedesktop/secrets/aliases/default"
+)
+
+// secret Secret Service中的(oayays)结构
+type secret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+//secretStore 通过org.freedesktop.secrets(Secret Service API)保存token
+type secretStore struct {
+	label      string
+	attributes map[string]string
+}
+
+func newSecretStore(cfg *Config) (TokenStore, error) {
+	conn, err := GetBus(BusSession).Conn()
+	if err != nil {
+		return nil, err
+	}
+	var has bool
+	err = conn.BusObject().Call(orgFreedesktopDBus+".NameHasOwner", 0, secretService).Store(&has)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		// 未运行时尝试通过dbus激活
+		var activatable []string
+		err = conn.BusObject().Call(orgFreedesktopDBus+".ListActivatableNames", 0).Store(&activatable)
+		if err != nil {
+			return nil, err
+		}
+		if !contains(activatable, secretService) {
+			return nil, errors.New("secret service not found")
+		}
+	}
+	return &secretStore{
+		label: "utMsgDaemon token",
+		attributes: map[string]string{
+			"application": "utMsgDaemon",
+			"service":     cfg.Service.Name,
+		},
+	}, nil
+}
+
+func (s *secretStore) Load() (string, error) {
+	conn, session, err := s.openSession()
+	if err != nil {
+		return "", err
+	}
+	defer s.closeSession(conn, session)
+	item, err := s.search(conn)
+	if err != nil || len(item) == 0 {
+		return "", err
+	}
+	var sec secret
+	err = conn.Object(secretService, item).Call(secretItemInterface+".GetSecret", 0, session).Store(&sec)
+	if err != nil {
+		return "", err
+	}
+	return string(sec.Value), nil
+}
+
+func (s *secretStore) Save(token string) error {
+	conn, session, err := s.openSession()
+	if err != nil {
+		return err
+	}
+	defer s.closeSession(conn, session)
+	props := map[string]dbus.Variant{
+		secretItemInterface + ".Label":      dbus.MakeVariant(s.label),
+		secretItemInterface + ".Attributes": dbus.MakeVariant(s.attributes),
+	}
+	sec := secret{
+		Session:     session,
+		Parameters:  []byte{},
+		Value:       []byte(token),
+		ContentType: "text/plain",
+	}
+	var item, prompt dbus.ObjectPath
+	err = conn.Object(secretService, secretDefaultCollection).Call(secretCollectionIface+".CreateItem", 0,
+		props, sec, true).Store(&item, &prompt)
+	if err != nil {
+		return err
+	}
+	if prompt != "/" {
+		return errors.New("secret collection locked")
+	}
+	return nil
+}
+
+func (s *secretStore) Clear() error {
+	conn, err := GetBus(BusSession).Conn()
+	if err != nil {
+		return err
+	}
+	item, err := s.search(conn)
+	if err != nil || len(item) == 0 {
+		return err
+	}
+	var prompt dbus.ObjectPath
+	err = conn.Object(secretService, item).Call(secretItemInterface+".Delete", 0).Store(&prompt)
+	if err != nil {
+		return err
+	}
+	if prompt != "/" {
+		return errors.New("secret collection locked")
+	}
+	return nil
+}
+
+//----------------------辅助函数------------------------
+
+//openSession 打开明文传输的会话，token只在本机dbus上传输
+func (s *secretStore) openSession() (*dbus.Conn, dbus.ObjectPath, error) {
+	conn, err := GetBus(BusSession).Conn()
+	if err != nil {
+		return nil, "", err
+	}
+	var output dbus.Variant
+	var session dbus.ObjectPath
+	err = conn.Object(secretService, secretPath).Call(secretServiceInterface+".OpenSession", 0,
+		"plain", dbus.MakeVariant("")).Store(&output, &session)
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, session, nil
+}
+
+func (s *secretStore) closeSession(conn *dbus.Conn, session dbus.ObjectPath) {
+	_ = conn.Object(secretService, session).Call("org.freedesktop.Secret.Session.Close", 0).Err
+}
+
+//search 查找已保存的token，集合被锁定时返回错误
+func (s *secretStore) search(conn *dbus.Conn) (dbus.ObjectPath, error) {
+	var unlocked, locked []dbus.ObjectPath
+	err := conn.Object(secretService, secretPath).Call(secretServiceInterface+".SearchItems", 0,
+		s.attributes).Store(&unlocked, &locked)
+	if err != nil {
+		return "", err
+	}
+	if len(unlocked) != 0 {
+		return unlocked[0], nil
+	}
+	if len(locked) != 0 {
+		return "", errors.New("secret collection locked")
+	}
+	return "", nil
+}
+
+func contains(items []string, v string) bool {
+	for _, item := range items {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	StorageOSS   = "oss"   //阿里云oss，使用服务端签发的临时授权地址
+	StorageS3    = "s3"    //S3兼容存储(如MinIO)，使用服务端签发的预签名地址
+	StorageLocal = "local" //本地目录，不经过utcloud服务端，用于离线测试及私有化部署
+)
+
+//ObjectInfo 云端文件信息
+type ObjectInfo struct {
+	Size    int64
+	ETag    string
+	MD5     string //存储能提供时不为空
+	ModTime time.Time
+}
+
+//Storage 对象存储
+//location为服务端签发的临时授权地址，Presigned返回false时为对象key
+type Storage interface {
+	//Put 上传本地文件，md5sum不为空时由存储校验
+	Put(ctx context.Context, location, localFile, md5sum string, progress ProgressFunc) error
+	//Get 下载到本地文件，md5sum不为空时校验通过后才写入localFile
+	Get(ctx context.Context, location, localFile, md5sum string, progress ProgressFunc) error
+	Stat(ctx context.Context, location string) (ObjectInfo, error)
+	Delete(ctx context.Context, location string) error
+	//Presigned location是否需要向utcloud服务端申请
+	Presigned() bool
+}
+
+//
+// NewStorage
+//  @Description: 按配置创建对象存储
+//  @param cfg
+//  @return Storage
+//  @return error
+//
+func NewStorage(cfg *Config) (Storage, error) {
+	switch cfg.Storage.Driver {
+	case StorageOSS:
+		return &ossStorage{}, nil
+	case StorageS3:
+		return &s3Storage{}, nil
+	case StorageLocal:
+		root := cfg.Storage.LocalRoot
+		if len(root) == 0 {
+			root = cfg.StatePath("storage")
+		}
+		return &localStorage{root: root}, nil
+	}
+	return nil, fmt.Errorf("unknown storage driver %s", cfg.Storage.Driver)
+}
+
+// CurrentStorage 获取当前配置的对象存储
+func CurrentStorage() (Storage, error) {
+	return NewStorage(Conf())
+}
+
+//----------------------辅助函数------------------------
+
+//
+// saveVerified
+//  @Description: 将reader写入localFile.part，md5sum不为空时校验通过后才重命名为localFile
+//  @param ctx 取消时中断写入并删除临时文件；localFile以ctx中设置的用户的权限创建
+//  @param direction 传输方向，用于限速
+//  @param reader
+//  @param total 数据长度，用于上报进度
+//  @param localFile
+//  @param md5sum
+//  @param progress
+//  @return error
+//
+func saveVerified(ctx context.Context, direction string, reader io.Reader, total int64, localFile, md5sum string, progress ProgressFunc) error {
+	tmp := localFile + partFileSuffix
+	fd, err := openFile(ctx, tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(fd, hash), newTransferReader(ctx, direction, reader, total, progress))
+	if serr := fd.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && len(md5sum) != 0 && !strings.EqualFold(hex.EncodeToString(hash.Sum(nil)), md5sum) {
+		log.Errorf("md5 mismatch, expect:[%s] actual:[%x]", md5sum, hash.Sum(nil))
+		err = ErrMD5Mismatch
+	}
+	return asOwner(ctx, func() error {
+		if err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+		return os.Rename(tmp, localFile)
+	})
+}
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//localStorage 以本地目录作为对象存储，location为对象key
+type localStorage struct {
+	root string
+}
+
+func (l *localStorage) Put(ctx context.Context, location, localFile, md5sum string, progress ProgressFunc) error {
+	target, err := l.path(location)
+	if err != nil {
+		return err
+	}
+	src, err := openFile(ctx, localFile, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if err := MakeDir(filepath.Dir(target)); err != nil {
+		return err
+	}
+	// 存储目录属于守护进程
+	return saveVerified(withoutOwner(ctx), TransferUpload, src, info.Size(), target, md5sum, progress)
+}
+
+func (l *localStorage) Get(ctx context.Context, location, localFile, md5sum string, progress ProgressFunc) error {
+	source, err := l.path(location)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(source)
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	} else if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	return saveVerified(ctx, TransferDownload, src, info.Size(), localFile, md5sum, progress)
+}
+
+func (l *localStorage) Stat(ctx context.Context, location string) (ObjectInfo, error) {
+	source, err := l.path(location)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(source)
+	if os.IsNotExist(err) {
+		return ObjectInfo{}, ErrNotExist
+	} else if err != nil {
+		return ObjectInfo{}, err
+	}
+	_, hash, err := md5sumAndsize(withoutOwner(ctx), source, true)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Size: info.Size(), ETag: hash, MD5: hash, ModTime: info.ModTime()}, nil
+}
+
+func (l *localStorage) Delete(ctx context.Context, location string) error {
+	source, err := l.path(location)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(source)
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	}
+	return err
+}
+
+func (l *localStorage) Presigned() bool {
+	return false
+}
+
+//path 对象key对应的文件路径，不允许访问根目录以外的文件
+func (l *localStorage) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.HasSuffix(clean, partFileSuffix) {
+		return "", &Error{Kind: KindInvalidArgument, Code: -1, Message: "invalid key"}
+	}
+	return filepath.Join(l.root, clean), nil
+}
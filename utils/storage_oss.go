@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+)
+
+//ossStorage 通过临时授权地址访问阿里云oss
+type ossStorage struct{}
+
+func (o *ossStorage) Put(ctx context.Context, location, localFile, md5sum string, progress ProgressFunc) error {
+	bucket, err := GetBucket(location)
+	if err != nil {
+		return err
+	}
+	return PutObject(ctx, bucket, location, localFile, md5sum, progress)
+}
+
+func (o *ossStorage) Get(ctx context.Context, location, localFile, md5sum string, progress ProgressFunc) error {
+	bucket, err := GetBucket(location)
+	if err != nil {
+		return err
+	}
+	return GetObject(ctx, bucket, location, localFile, md5sum, progress)
+}
+
+func (o *ossStorage) Stat(ctx context.Context, location string) (ObjectInfo, error) {
+	bucket, err := GetBucket(location)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, _, err := probeObject(ctx, ossRangeGetter(bucket, location))
+	if err != nil {
+		return ObjectInfo{}, ossMapError(err)
+	}
+	return info, nil
+}
+
+func (o *ossStorage) Delete(ctx context.Context, location string) error {
+	bucket, err := GetBucket(location)
+	if err != nil {
+		return err
+	}
+	resp, err := bucket.Client.Conn.DoURL(http.MethodDelete, location, map[string]string{}, nil, 0, nil)
+	if err != nil {
+		return ossMapError(err)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+func (o *ossStorage) Presigned() bool {
+	return true
+}
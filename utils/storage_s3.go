@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//S3Error S3兼容存储返回的错误
+type S3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+	Resource   string `xml:"Resource"`
+	RequestID  string `xml:"RequestId"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: service returned error: StatusCode=%d, ErrorCode=%s, ErrorMessage=%q, RequestId=%s",
+		e.StatusCode, e.Code, e.Message, e.RequestID)
+}
+
+//s3Storage 通过预签名地址访问S3兼容存储(如MinIO)，大文件分片上传见multipartUpload
+type s3Storage struct{}
+
+func (s *s3Storage) Put(ctx context.Context, location, localFile, md5sum string, progress ProgressFunc) error {
+	fd, err := openFile(ctx, localFile, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return ErrNoFile
+	} else if err != nil {
+		return err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	body := newTransferReader(ctx, TransferUpload, fd, info.Size(), progress)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, location, ioutil.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	if info.Size() == 0 {
+		// 非nil的Body且ContentLength为0时按长度未知分块发送，部分S3实现不支持
+		req.Body = http.NoBody
+	}
+	if len(md5sum) != 0 {
+		// 签名时包含Content-MD5的预签名地址要求请求中带上相同的值
+		bmd5, err := hex.DecodeString(md5sum)
+		if err != nil {
+			return fmt.Errorf("invalid md5 %s", md5sum)
+		}
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(bmd5))
+	}
+	resp, err := s3Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return s3MapError(err)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, location, localFile, md5sum string, progress ProgressFunc) error {
+	if err := CheckWriteFile(ctx, localFile); err != nil {
+		return err
+	}
+	err := getObjectToFile(ctx, s3RangeGetter(location), localFile, md5sum, progress)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return s3MapError(err)
+}
+
+func (s *s3Storage) Stat(ctx context.Context, location string) (ObjectInfo, error) {
+	// 预签名地址只对签名时的方法有效，使用GET请求第一个字节代替HEAD
+	info, _, err := probeObject(ctx, s3RangeGetter(location))
+	return info, s3MapError(err)
+}
+
+func (s *s3Storage) Delete(ctx context.Context, location string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, location, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s3Do(req)
+	if err != nil {
+		return s3MapError(err)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Presigned() bool {
+	return true
+}
+
+//----------------------辅助函数------------------------
+
+//s3RangeGetter 通过预签名地址请求对象数据
+func s3RangeGetter(location string) rangeGetter {
+	return func(ctx context.Context, start, end int64) (*rangeResponse, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return nil, err
+		}
+		if start >= 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		}
+		resp, err := s3Do(req)
+		if err != nil {
+			var serr *S3Error
+			if errors.As(err, &serr) && serr.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+				return nil, errRangeNotSatisfiable
+			}
+			return nil, err
+		}
+		return &rangeResponse{StatusCode: resp.StatusCode, Header: resp.Header, Body: resp.Body}, nil
+	}
+}
+
+//s3Do 通过共用的客户端发送请求，非2xx响应转换为S3Error
+func s3Do(req *http.Request) (*http.Response, error) {
+	resp, err := doTransfer(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, parseS3Error(resp.StatusCode, resp.Body)
+}
+
+//parseS3Error 解析S3的XML错误，oss分片接口返回相同格式的错误
+func parseS3Error(statusCode int, body io.Reader) *S3Error {
+	data, _ := ioutil.ReadAll(io.LimitReader(body, 4096))
+	serr := &S3Error{}
+	if err := xml.Unmarshal(data, serr); err != nil || len(serr.Code) == 0 {
+		serr.Code = strings.ReplaceAll(http.StatusText(statusCode), " ", "")
+		serr.Message = strings.TrimSpace(string(data))
+	}
+	serr.StatusCode = statusCode
+	return serr
+}
+
+//s3ErrorInBody 部分接口(如合并分片)在200响应中返回错误
+func s3ErrorInBody(statusCode int, data []byte) *S3Error {
+	if !bytes.Contains(data, []byte("<Error>")) {
+		return nil
+	}
+	return parseS3Error(statusCode, bytes.NewReader(data))
+}
+
+//s3MapError 转换为与oss一致的带类型的错误，保留原始的S3Error
+func s3MapError(err error) error {
+	var serr *S3Error
+	if err == nil || !errors.As(err, &serr) {
+		return err
+	}
+	switch {
+	case serr.StatusCode == http.StatusNotFound || serr.Code == "NoSuchKey":
+		return &Error{Kind: KindNotFound, Code: int32(serr.StatusCode), Message: ErrNotExist.Message, Err: serr}
+	case serr.Code == "BadDigest" || serr.Code == "InvalidDigest":
+		return ErrMD5Mismatch
+	}
+	kind := statusKind(serr.StatusCode)
+	switch serr.Code {
+	case "AccessDenied", "SignatureDoesNotMatch":
+		kind = KindPermissionDenied
+	case "EntityTooLarge", "QuotaExceeded":
+		kind = KindQuotaExceeded
+	}
+	return &Error{Kind: kind, Code: int32(serr.StatusCode), Message: serr.Error(), Err: serr}
+}
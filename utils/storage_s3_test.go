@@ -0,0 +1,391 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+//setS3TestConf 使用临时状态目录及最小分片，测试结束后恢复配置
+func setS3TestConf(t *testing.T) *Config {
+	old := Conf()
+	t.Cleanup(func() { SetConf(old) })
+	c := DefaultConfig()
+	c.StateDir = t.TempDir()
+	c.Transfer.PartSize = minPartSize
+	c.Transfer.Parallel = 2
+	SetConf(c)
+	return c
+}
+
+func s3ErrorBody(code, message string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>%s</Code><Message>%s</Message><Resource>/bucket/key</Resource><RequestId>req-1</RequestId></Error>`, code, message)
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestS3PutContentMD5(t *testing.T) {
+	setS3TestConf(t)
+	data := testData(1000)
+	sum := md5.Sum(data)
+	local := filepath.Join(t.TempDir(), "a.bin")
+	if err := ioutil.WriteFile(local, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var header string
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("expect PUT, got %s", r.Method)
+		}
+		header = r.Header.Get("Content-MD5")
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	}))
+	defer srv.Close()
+
+	s := &s3Storage{}
+	if err := s.Put(context.Background(), srv.URL+"/a.bin", local, hex.EncodeToString(sum[:]), nil); err != nil {
+		t.Fatal(err)
+	}
+	if expect := base64.StdEncoding.EncodeToString(sum[:]); header != expect {
+		t.Fatalf("expect Content-MD5 %s, got %q", expect, header)
+	}
+	if !bytes.Equal(body, data) {
+		t.Fatal("uploaded body mismatch")
+	}
+
+	// 没有md5时不带Content-MD5
+	if err := s.Put(context.Background(), srv.URL+"/a.bin", local, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(header) != 0 {
+		t.Fatalf("expect no Content-MD5, got %q", header)
+	}
+	if err := s.Put(context.Background(), srv.URL+"/a.bin", local, "not-hex", nil); err == nil {
+		t.Fatal("expect invalid md5 error")
+	}
+}
+
+func TestS3PutEmpty(t *testing.T) {
+	setS3TestConf(t)
+	sum := md5.Sum(nil)
+	local := filepath.Join(t.TempDir(), "empty.bin")
+	if err := ioutil.WriteFile(local, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var length int64 = -1
+	var encoding []string
+	var header string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		length, encoding = r.ContentLength, r.TransferEncoding
+		header = r.Header.Get("Content-MD5")
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	}))
+	defer srv.Close()
+
+	// 空文件不能按分块发送
+	if err := (&s3Storage{}).Put(context.Background(), srv.URL+"/empty.bin", local, hex.EncodeToString(sum[:]), nil); err != nil {
+		t.Fatal(err)
+	}
+	if length != 0 || len(encoding) != 0 {
+		t.Fatalf("expect Content-Length 0 without chunked encoding, got length %d encoding %v", length, encoding)
+	}
+	if expect := base64.StdEncoding.EncodeToString(sum[:]); header != expect {
+		t.Fatalf("expect Content-MD5 %s, got %q", expect, header)
+	}
+}
+
+func TestS3TransferTimeout(t *testing.T) {
+	cases := []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request, release chan struct{})
+	}{
+		{
+			name: "no response",
+			handler: func(w http.ResponseWriter, r *http.Request, release chan struct{}) {
+				<-release
+			},
+		},
+		{
+			name: "body stalled",
+			handler: func(w http.ResponseWriter, r *http.Request, release chan struct{}) {
+				w.Header().Set("Content-Length", "1000")
+				w.Write(testData(10))
+				w.(http.Flusher).Flush()
+				<-release
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := setS3TestConf(t)
+			cfg.Transfer.Timeout = 100 * time.Millisecond
+			release := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tc.handler(w, r, release)
+			}))
+			defer srv.Close()
+			defer close(release)
+
+			start := time.Now()
+			err := (&s3Storage{}).Get(context.Background(), srv.URL+"/e.bin", filepath.Join(t.TempDir(), "e.bin"), "", nil)
+			if err != errTransferStalled {
+				t.Fatalf("expect %v, got %v", errTransferStalled, err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("timeout not applied, took %s", elapsed)
+			}
+		})
+	}
+}
+
+//rangeServer 支持Range的对象服务，记录收到的Range头
+type rangeServer struct {
+	mu     sync.Mutex
+	data   []byte
+	ranges []string
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	s.mu.Unlock()
+	sum := md5.Sum(s.data)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.data))
+}
+
+func (s *rangeServer) requested(v string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, item := range s.ranges {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+func TestS3GetRanges(t *testing.T) {
+	setS3TestConf(t)
+	data := testData(minPartSize*2 + 5000)
+	rs := &rangeServer{data: data}
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	local := filepath.Join(t.TempDir(), "b.bin")
+	s := &s3Storage{}
+	if err := s.Get(context.Background(), srv.URL+"/b.bin", local, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded data mismatch")
+	}
+	for _, v := range []string{"bytes=0-0", fmt.Sprintf("bytes=0-%d", minPartSize-1),
+		fmt.Sprintf("bytes=%d-%d", minPartSize*2, len(data)-1)} {
+		if !rs.requested(v) {
+			t.Fatalf("expect range %s requested, got %v", v, rs.ranges)
+		}
+	}
+	if _, err := os.Stat(local + partFileSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expect part file removed, got %v", err)
+	}
+
+	info, err := s.Stat(context.Background(), srv.URL+"/b.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(data)
+	if info.Size != int64(len(data)) || info.MD5 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected object info %+v", info)
+	}
+}
+
+func TestS3GetResume(t *testing.T) {
+	cfg := setS3TestConf(t)
+	data := testData(minPartSize*2 + 5000)
+	sum := md5.Sum(data)
+	rs := &rangeServer{data: data}
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	// 模拟中断的下载，第一个分段已完成
+	local := filepath.Join(t.TempDir(), "c.bin")
+	tmp := local + partFileSuffix
+	if err := ioutil.WriteFile(tmp, data[:minPartSize], 0600); err != nil {
+		t.Fatal(err)
+	}
+	cpFile := downloadCheckpointFile(cfg, local)
+	cp := &downloadCheckpoint{
+		LocalFile: tmp,
+		Size:      int64(len(data)),
+		ETag:      `"` + hex.EncodeToString(sum[:]) + `"`,
+		PartSize:  minPartSize,
+		Parts:     map[int]bool{1: true},
+	}
+	if err := saveJSON(cpFile, cp); err != nil {
+		t.Fatal(err)
+	}
+
+	var done int64
+	s := &s3Storage{}
+	err := s.Get(context.Background(), srv.URL+"/c.bin", local, hex.EncodeToString(sum[:]), func(d, total int64) {
+		done = d
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.requested(fmt.Sprintf("bytes=0-%d", minPartSize-1)) {
+		t.Fatalf("finished part downloaded again, ranges %v", rs.ranges)
+	}
+	if !rs.requested(fmt.Sprintf("bytes=%d-%d", minPartSize, minPartSize*2-1)) {
+		t.Fatalf("expect second part requested, ranges %v", rs.ranges)
+	}
+	got, err := ioutil.ReadFile(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("resumed data mismatch")
+	}
+	if done != int64(len(data)) {
+		t.Fatalf("expect progress %d, got %d", len(data), done)
+	}
+	if _, err := os.Stat(cpFile); !os.IsNotExist(err) {
+		t.Fatalf("expect checkpoint removed, got %v", err)
+	}
+}
+
+func TestS3ErrorKind(t *testing.T) {
+	setS3TestConf(t)
+	local := filepath.Join(t.TempDir(), "d.bin")
+	if err := ioutil.WriteFile(local, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		status int
+		body   string
+		kind   ErrorKind
+		err    error
+	}{
+		{name: "no such key", status: http.StatusNotFound, body: s3ErrorBody("NoSuchKey", "The specified key does not exist."), kind: KindNotFound},
+		{name: "access denied", status: http.StatusForbidden, body: s3ErrorBody("AccessDenied", "Access Denied"), kind: KindPermissionDenied},
+		{name: "signature mismatch", status: http.StatusForbidden, body: s3ErrorBody("SignatureDoesNotMatch", "bad signature"), kind: KindPermissionDenied},
+		{name: "bad digest", status: http.StatusBadRequest, body: s3ErrorBody("BadDigest", "The Content-MD5 you specified did not match"), err: ErrMD5Mismatch},
+		{name: "entity too large", status: http.StatusBadRequest, body: s3ErrorBody("EntityTooLarge", "too large"), kind: KindQuotaExceeded},
+		{name: "not xml", status: http.StatusNotFound, body: "not found", kind: KindNotFound},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/xml")
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, tc.body)
+			}))
+			defer srv.Close()
+			err := (&s3Storage{}).Put(context.Background(), srv.URL+"/d.bin", local, "", nil)
+			if tc.err != nil {
+				if err != tc.err {
+					t.Fatalf("expect %v, got %v", tc.err, err)
+				}
+				return
+			}
+			var uerr *Error
+			if !errors.As(err, &uerr) || uerr.Kind != tc.kind {
+				t.Fatalf("expect kind %s, got %v", tc.kind, err)
+			}
+			var serr *S3Error
+			if !errors.As(err, &serr) || serr.StatusCode != tc.status {
+				t.Fatalf("expect S3Error with status %d kept, got %v", tc.status, err)
+			}
+		})
+	}
+}
+
+func TestS3CompleteMultipart(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		body   string
+		code   string //期望的S3Error.Code，为空时期望成功
+	}{
+		{
+			name:   "ok",
+			status: http.StatusOK,
+			body:   `<CompleteMultipartUploadResult><Key>key</Key><ETag>"abc-2"</ETag></CompleteMultipartUploadResult>`,
+		},
+		{
+			name:   "error in 200 body",
+			status: http.StatusOK,
+			body:   s3ErrorBody("InternalError", "We encountered an internal error. Please try again."),
+			code:   "InternalError",
+		},
+		{
+			name:   "invalid part",
+			status: http.StatusBadRequest,
+			body:   s3ErrorBody("InvalidPart", "One or more of the specified parts could not be found."),
+			code:   "InvalidPart",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var req completeMultipartUpload
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					t.Errorf("expect POST, got %s", r.Method)
+				}
+				data, _ := ioutil.ReadAll(r.Body)
+				if err := xml.Unmarshal(data, &req); err != nil {
+					t.Errorf("invalid request body %s", data)
+				}
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, tc.body)
+			}))
+			defer srv.Close()
+
+			cp := &uploadCheckpoint{Parts: map[int]string{2: `"e2"`, 1: `"e1"`}}
+			err := completeMultipart(context.Background(), srv.URL+"/key?uploadId=1", cp)
+			if len(req.Parts) != 2 || req.Parts[0].PartNumber != 1 || req.Parts[0].ETag != `"e1"` || req.Parts[1].PartNumber != 2 {
+				t.Fatalf("unexpected parts %+v", req.Parts)
+			}
+			if len(tc.code) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var serr *S3Error
+			if !errors.As(err, &serr) || serr.Code != tc.code {
+				t.Fatalf("expect S3Error %s, got %v", tc.code, err)
+			}
+		})
+	}
+}
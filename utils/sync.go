@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SyncUpload = "upload" //单向同步，本地目录镜像到云端
+	SyncTwoWay = "twoway" //双向同步，两端的变化互相同步
+)
+
+//ManifestEntry 已同步到云端的文件状态
+type ManifestEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	MD5     string    `json:"md5"`
+}
+
+//SyncManifest 目录同步清单，记录上次同步到云端的文件，key为相对路径
+type SyncManifest struct {
+	Dir    string                   `json:"dir"`
+	Prefix string                   `json:"prefix"`
+	Files  map[string]ManifestEntry `json:"files"`
+}
+
+//SyncStats 一次同步的结果
+type SyncStats struct {
+	Uploaded      int
+	Downloaded    int
+	Deleted       int
+	Unchanged     int
+	Conflicts     int
+	Failed        int
+	Deferred      int       //超过当前时段允许上传的大小，留到下次同步的文件数
+	DeferredUntil time.Time //Deferred不为0时最早可以上传的时间
+}
+
+func (s SyncStats) String() string {
+	return fmt.Sprintf("uploaded %d, downloaded %d, deleted %d, unchanged %d, conflicts %d, failed %d, deferred %d",
+		s.Uploaded, s.Downloaded, s.Deleted, s.Unchanged, s.Conflicts, s.Failed, s.Deferred)
+}
+
+//
+// SyncDir
+//  @Description: 将目录单向同步到云端prefix下：上传新增及内容变化的文件，删除本地已删除的文件；
+//  大小和修改时间未变的文件不重新计算md5，每个文件完成后更新清单，中断后再次同步时不会重复传输；
+//  超过当前时段允许上传大小的文件跳过，不更新清单，在stats.DeferredUntil之后再次同步时上传
+//  @param ctx 取消时中断同步
+//  @param token
+//  @param dir 本地目录
+//  @param prefix 云端key前缀
+//  @param manifestFile 同步清单文件
+//  @param progress 上传进度回调，可为nil
+//  @return SyncStats
+//  @return error 有文件同步失败时返回错误，其他文件仍会同步
+//
+func SyncDir(ctx context.Context, token, dir, prefix, manifestFile string, progress ProgressFunc) (SyncStats, error) {
+	var stats SyncStats
+	manifest := loadManifest(manifestFile)
+	if manifest == nil || manifest.Dir != dir || manifest.Prefix != prefix {
+		manifest = &SyncManifest{Dir: dir, Prefix: prefix, Files: map[string]ManifestEntry{}}
+	}
+	current, err := scanDir(ctx, dir, manifest)
+	if err != nil {
+		return stats, err
+	}
+
+	var uploads, removes []string
+	var total int64
+	for rel, entry := range current {
+		if old, has := manifest.Files[rel]; has && old.MD5 == entry.MD5 && old.Size == entry.Size {
+			stats.Unchanged++
+			if !old.ModTime.Equal(entry.ModTime) {
+				manifest.Files[rel] = entry
+			}
+			continue
+		}
+		uploads = append(uploads, rel)
+		total += entry.Size
+	}
+	for rel := range manifest.Files {
+		if _, has := current[rel]; !has {
+			removes = append(removes, rel)
+		}
+	}
+	sort.Strings(uploads)
+	sort.Strings(removes)
+	log.Infof("sync %s to %s: %d to upload, %d to delete", dir, prefix, len(uploads), len(removes))
+
+	var done int64
+	if progress != nil {
+		progress(0, total)
+	}
+	for _, rel := range uploads {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		entry := current[rel]
+		base := done
+		if stats.deferUpload(rel, entry.Size) {
+			done = base + entry.Size
+			continue
+		}
+		_, err := UploadToKey(ctx, token, RemoteKey(prefix, rel), filepath.Join(dir, rel), func(n, _ int64) {
+			if progress != nil {
+				progress(base+n, total)
+			}
+		})
+		done = base + entry.Size
+		if err != nil {
+			if ctx.Err() != nil {
+				return stats, ctx.Err()
+			}
+			log.Errorf("sync upload %s error:[%s]", rel, err.Error())
+			stats.Failed++
+			continue
+		}
+		stats.Uploaded++
+		manifest.Files[rel] = entry
+		saveManifestLog(manifestFile, manifest)
+	}
+	for _, rel := range removes {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		_, err := DeleteDaemon(token, RemoteKey(prefix, rel))
+		if err != nil && KindOf(err) != KindNotFound {
+			log.Errorf("sync delete %s error:[%s]", rel, err.Error())
+			stats.Failed++
+			continue
+		}
+		stats.Deleted++
+		delete(manifest.Files, rel)
+		saveManifestLog(manifestFile, manifest)
+	}
+	saveManifestLog(manifestFile, manifest)
+	if stats.Failed != 0 {
+		return stats, fmt.Errorf("%d files failed to sync", stats.Failed)
+	}
+	return stats, nil
+}
+
+// RemoteKey 相对路径对应的云端key
+func RemoteKey(prefix, rel string) string {
+	return strings.TrimRight(prefix, "/") + "/" + filepath.ToSlash(rel)
+}
+
+// SyncIgnored 文件或目录名是否匹配sync.ignore，匹配的不同步
+func SyncIgnored(name string) bool {
+	base := filepath.Base(name)
+	for _, pattern := range Conf().Sync.Ignore {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//----------------------辅助函数------------------------
+
+//deferUpload 按时段配置判断文件现在能否上传，不能时记录到统计中并返回true
+func (s *SyncStats) deferUpload(rel string, size int64) bool {
+	until, deferred := UploadDeferredUntil(size, time.Now())
+	if !deferred {
+		return false
+	}
+	log.Infof("sync upload %s deferred until %s", rel, until.Format("2006-01-02 15:04:05"))
+	s.Deferred++
+	if s.DeferredUntil.IsZero() || until.Before(s.DeferredUntil) {
+		s.DeferredUntil = until
+	}
+	return true
+}
+
+//scanDir 获取目录下所有普通文件的状态，大小和修改时间与清单一致时沿用清单中的md5，文件以ctx中设置的用户的权限读取
+func scanDir(ctx context.Context, dir string, manifest *SyncManifest) (map[string]ManifestEntry, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	files := map[string]ManifestEntry{}
+	err = filepath.Walk(dir, func(item string, info os.FileInfo, err error) error {
+		if err != nil {
+			// 无法访问的子目录不影响其他文件
+			log.Warnf("sync scan %s error:[%s]", item, err.Error())
+			if info != nil && info.IsDir() && item != dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if item != dir && SyncIgnored(item) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(item, partFileSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, item)
+		if err != nil || rel == remoteIndexName {
+			return nil
+		}
+		entry := ManifestEntry{Size: info.Size(), ModTime: info.ModTime()}
+		if old, has := manifest.Files[rel]; has && old.Size == entry.Size && old.ModTime.Equal(entry.ModTime) {
+			entry.MD5 = old.MD5
+		} else if _, entry.MD5, err = md5sumAndsize(ctx, item, true); err != nil {
+			log.Warnf("sync md5 %s error:[%s]", item, err.Error())
+			return nil
+		}
+		files[rel] = entry
+		return nil
+	})
+	return files, err
+}
+
+func loadManifest(file string) *SyncManifest {
+	manifest := &SyncManifest{}
+	if !loadJSON(file, manifest) {
+		return nil
+	}
+	if manifest.Files == nil {
+		manifest.Files = map[string]ManifestEntry{}
+	}
+	return manifest
+}
+
+//saveManifestLog 保存同步清单，失败时只记录日志，下次同步会重新比较
+func saveManifestLog(file string, manifest *SyncManifest) {
+	if err := saveJSON(file, manifest); err != nil {
+		log.Errorf("save sync manifest error:[%s]", err.Error())
+	}
+}
@@ -0,0 +1,339 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//remoteIndexName 双向同步时保存在云端prefix下的文件索引，记录最后一次同步后云端的文件状态
+const remoteIndexName = ".utsync-index.json"
+
+//SyncConflictFunc 双向同步冲突回调，rel为冲突文件的相对路径，conflictFile为保存云端版本的冲突副本
+type SyncConflictFunc func(rel, conflictFile string)
+
+const (
+	opUpload       = iota //本地变化，上传
+	opDeleteRemote        //本地已删除，删除云端
+	opDownload            //云端变化，下载
+	opDeleteLocal         //云端已删除，删除本地
+	opConflict            //两端都有变化，保存云端版本为冲突副本后上传本地版本
+)
+
+//
+// SyncDirTwoWay
+//  @Description: 双向同步目录与云端prefix。以清单中上次同步的状态为基准，与本地文件和云端索引分别比较：
+//  只有一端变化时同步到另一端，修改优先于删除；两端都修改且内容不同时将云端版本下载为冲突副本，
+//  保留并上传本地版本，冲突副本在下次同步时上传，由客户端合并后删除；本地版本超过当前时段允许上传的大小时，
+//  上传及冲突处理都留到stats.DeferredUntil之后的同步
+//  @param ctx 取消时中断同步
+//  @param token
+//  @param dir 本地目录
+//  @param prefix 云端key前缀
+//  @param manifestFile 同步清单文件
+//  @param onConflict 产生冲突副本时回调，可为nil
+//  @param progress 传输进度回调，可为nil
+//  @return SyncStats
+//  @return error 有文件同步失败时返回错误，其他文件仍会同步
+//
+func SyncDirTwoWay(ctx context.Context, token, dir, prefix, manifestFile string, onConflict SyncConflictFunc, progress ProgressFunc) (SyncStats, error) {
+	var stats SyncStats
+	manifest := loadManifest(manifestFile)
+	if manifest == nil || manifest.Dir != dir || manifest.Prefix != prefix {
+		manifest = &SyncManifest{Dir: dir, Prefix: prefix, Files: map[string]ManifestEntry{}}
+	}
+	current, err := scanDir(ctx, dir, manifest)
+	if err != nil {
+		return stats, err
+	}
+	indexFile := manifestFile + ".remote"
+	defer os.Remove(indexFile)
+	remote, err := fetchRemoteIndex(ctx, token, prefix, indexFile)
+	if err != nil {
+		return stats, err
+	}
+
+	names := map[string]bool{}
+	for _, files := range []map[string]ManifestEntry{current, manifest.Files, remote} {
+		for rel := range files {
+			names[rel] = true
+		}
+	}
+	ops := map[string]int{}
+	var plan []string
+	var total int64
+	for rel := range names {
+		local, hasL := current[rel]
+		base, hasB := manifest.Files[rel]
+		rem, hasR := remote[rel]
+		localChanged := hasL != hasB || (hasL && local.MD5 != base.MD5)
+		remoteChanged := hasR != hasB || (hasR && rem.MD5 != base.MD5)
+		switch {
+		case !localChanged && !remoteChanged:
+			stats.Unchanged++
+			if hasL {
+				manifest.Files[rel] = local
+			}
+			continue
+		case hasL == hasR && (!hasL || local.MD5 == rem.MD5):
+			// 两端变化相同
+			stats.Unchanged++
+			if hasL {
+				manifest.Files[rel] = local
+			} else {
+				delete(manifest.Files, rel)
+			}
+			continue
+		case !remoteChanged || (hasL && !hasR && localChanged):
+			ops[rel] = opDeleteRemote
+			if hasL {
+				ops[rel] = opUpload
+				total += local.Size
+			}
+		case !localChanged || (hasR && !hasL):
+			ops[rel] = opDeleteLocal
+			if hasR {
+				ops[rel] = opDownload
+				total += rem.Size
+			}
+		default:
+			ops[rel] = opConflict
+			total += local.Size + rem.Size
+		}
+		plan = append(plan, rel)
+	}
+	sort.Strings(plan)
+	log.Infof("two-way sync %s with %s: %d changes", dir, prefix, len(plan))
+	saveManifestLog(manifestFile, manifest)
+
+	// 上传和删除云端文件后需要更新云端索引，索引上传成功后才更新清单，
+	// 否则下次同步时会把旧索引当作云端的变化
+	pending := map[string]*ManifestEntry{}
+	var done int64
+	if progress != nil {
+		progress(0, total)
+	}
+	transfer := func(size int64) ProgressFunc {
+		base := done
+		done += size
+		return func(n, _ int64) {
+			if progress != nil {
+				progress(base+n, total)
+			}
+		}
+	}
+	for _, rel := range plan {
+		if ctx.Err() != nil {
+			break
+		}
+		local, rem := current[rel], remote[rel]
+		key := RemoteKey(prefix, rel)
+		var err error
+		if (ops[rel] == opUpload || ops[rel] == opConflict) && stats.deferUpload(rel, local.Size) {
+			// 不更新清单，下次同步时仍按本地变化处理
+			continue
+		}
+		switch ops[rel] {
+		case opUpload:
+			if _, err = UploadToKey(ctx, token, key, filepath.Join(dir, rel), transfer(local.Size)); err == nil {
+				stats.Uploaded++
+				remote[rel] = local
+				pending[rel] = &local
+			}
+		case opDeleteRemote:
+			if _, err = DeleteDaemon(token, key); err == nil || KindOf(err) == KindNotFound {
+				err = nil
+				stats.Deleted++
+				delete(remote, rel)
+				pending[rel] = nil
+			}
+		case opDownload:
+			var entry ManifestEntry
+			if entry, err = syncDownload(ctx, token, dir, key, rel, transfer(rem.Size)); err == nil {
+				stats.Downloaded++
+				manifest.Files[rel] = entry
+				saveManifestLog(manifestFile, manifest)
+			}
+		case opDeleteLocal:
+			err = asOwner(ctx, func() error { return os.Remove(filepath.Join(dir, rel)) })
+			if err == nil || os.IsNotExist(err) {
+				err = nil
+				stats.Deleted++
+				delete(manifest.Files, rel)
+				saveManifestLog(manifestFile, manifest)
+			}
+		case opConflict:
+			copyRel := conflictName(rel)
+			if _, err = syncDownload(ctx, token, dir, key, copyRel, transfer(rem.Size)); err != nil {
+				break
+			}
+			stats.Conflicts++
+			log.Warnf("sync conflict %s, remote version saved as %s", rel, copyRel)
+			if onConflict != nil {
+				onConflict(rel, filepath.Join(dir, copyRel))
+			}
+			if _, err = UploadToKey(ctx, token, key, filepath.Join(dir, rel), transfer(local.Size)); err == nil {
+				stats.Uploaded++
+				remote[rel] = local
+				pending[rel] = &local
+			}
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("sync %s error:[%s]", rel, err.Error())
+			stats.Failed++
+		}
+	}
+
+	if len(pending) != 0 {
+		if err := putRemoteIndex(token, prefix, indexFile, remote); err != nil {
+			log.Errorf("upload sync index error:[%s]", err.Error())
+			return stats, err
+		}
+		for rel, entry := range pending {
+			if entry == nil {
+				delete(manifest.Files, rel)
+			} else {
+				manifest.Files[rel] = *entry
+			}
+		}
+		saveManifestLog(manifestFile, manifest)
+	}
+	if ctx.Err() != nil {
+		return stats, ctx.Err()
+	}
+	if stats.Failed != 0 {
+		return stats, fmt.Errorf("%d files failed to sync", stats.Failed)
+	}
+	return stats, nil
+}
+
+//----------------------辅助函数------------------------
+
+//fetchRemoteIndex 下载云端索引，云端还没有索引时返回空索引
+func fetchRemoteIndex(ctx context.Context, token, prefix, indexFile string) (map[string]ManifestEntry, error) {
+	index := map[string]ManifestEntry{}
+	if err := MakeDir(filepath.Dir(indexFile)); err != nil {
+		return nil, err
+	}
+	// 索引文件在状态目录下，以守护进程自己的权限写入
+	err := DownloadUtDaemon(withoutOwner(ctx), token, RemoteKey(prefix, remoteIndexName), indexFile, nil)
+	if err != nil {
+		if KindOf(err) == KindNotFound {
+			return index, nil
+		}
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(indexFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid sync index: %v", err)
+	}
+	for rel := range index {
+		// 索引由其他设备写入，不能信任其中的路径
+		if !validSyncRel(rel) {
+			log.Warnf("sync index contains invalid path %q, ignored", rel)
+			delete(index, rel)
+		}
+	}
+	return index, nil
+}
+
+//putRemoteIndex 上传云端索引
+func putRemoteIndex(token, prefix, indexFile string, index map[string]ManifestEntry) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(indexFile, data, 0600); err != nil {
+		return err
+	}
+	// 索引必须与已完成的传输保持一致，不随同步任务取消
+	_, err = UploadToKey(context.Background(), token, RemoteKey(prefix, remoteIndexName), indexFile, nil)
+	return err
+}
+
+//syncDownload 以ctx中设置的用户的权限下载云端文件到目录下的rel，返回下载后的文件状态
+func syncDownload(ctx context.Context, token, dir, key, rel string, progress ProgressFunc) (ManifestEntry, error) {
+	file := filepath.Join(dir, rel)
+	if err := makeSyncDir(ctx, dir, filepath.Dir(file)); err != nil {
+		return ManifestEntry{}, err
+	}
+	if info, err := os.Lstat(file); err == nil && !info.Mode().IsRegular() {
+		return ManifestEntry{}, fmt.Errorf("%s is not a regular file", file)
+	}
+	if err := DownloadUtDaemon(ctx, token, key, file, progress); err != nil {
+		return ManifestEntry{}, err
+	}
+	var info os.FileInfo
+	err := asOwner(ctx, func() error {
+		var err error
+		info, err = os.Stat(file)
+		return err
+	})
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	_, md5sum, err := md5sumAndsize(ctx, file, true)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	return ManifestEntry{Size: info.Size(), ModTime: info.ModTime(), MD5: md5sum}, nil
+}
+
+//makeSyncDir 以ctx中设置的用户的权限创建同步目录下的子目录；已有的上级目录不能通过符号链接指向同步目录外
+func makeSyncDir(ctx context.Context, root, dir string) error {
+	exist := dir
+	for ; len(exist) > len(root); exist = filepath.Dir(exist) {
+		if _, err := os.Lstat(exist); err == nil {
+			break
+		}
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	realDir, err := filepath.EvalSymlinks(exist)
+	if err != nil {
+		return err
+	}
+	if realDir != realRoot && !strings.HasPrefix(realDir, realRoot+string(filepath.Separator)) {
+		return errors.New("path escapes sync directory")
+	}
+	return asOwner(ctx, func() error {
+		return MakeDir(dir)
+	})
+}
+
+//conflictName 冲突副本的相对路径，如a.txt保存为a.conflict-20220101150405.txt
+func conflictName(rel string) string {
+	ext := filepath.Ext(rel)
+	return strings.TrimSuffix(rel, ext) + ".conflict-" + time.Now().Format("20060102150405") + ext
+}
+
+//validSyncRel 相对路径是否在同步目录内且需要同步
+func validSyncRel(rel string) bool {
+	if len(rel) == 0 || filepath.IsAbs(rel) || filepath.Clean(rel) != rel || rel == "." ||
+		rel == ".." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+	if rel == remoteIndexName || strings.HasSuffix(rel, partFileSuffix) {
+		return false
+	}
+	for _, name := range strings.Split(rel, "/") {
+		if SyncIgnored(name) {
+			return false
+		}
+	}
+	return true
+}
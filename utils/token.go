@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	TokenStoreAuto   = "auto"
+	TokenStoreSecret = "secret-service"
+	TokenStoreFile   = "file"
+)
+
+//TokenStore 云服务token持久化存储
+type TokenStore interface {
+	Load() (string, error) //未保存过token时返回空字符串
+	Save(token string) error
+	Clear() error
+}
+
+//
+// NewTokenStore
+//  @Description: 按配置创建token存储，auto模式下session总线优先使用Secret Service，不可用时使用加密文件
+//  @param cfg
+//  @return TokenStore
+//  @return error
+//
+func NewTokenStore(cfg *Config) (TokenStore, error) {
+	switch cfg.Token.Store {
+	case TokenStoreSecret:
+		return newSecretStore(cfg)
+	case TokenStoreFile:
+		return newFileTokenStore(cfg)
+	}
+	if cfg.Service.Bus == BusSession {
+		store, err := newSecretStore(cfg)
+		if err == nil {
+			return store, nil
+		}
+		log.Warnf("secret service unavailable, use encrypted file:[%s]", err.Error())
+	}
+	return newFileTokenStore(cfg)
+}
+
+//fileTokenStore 使用本机machine-id派生的密钥加密后保存到文件
+type fileTokenStore struct {
+	file string
+	key  []byte
+}
+
+func newFileTokenStore(cfg *Config) (TokenStore, error) {
+	machineID, err := readMachineID()
+	if err != nil {
+		return nil, err
+	}
+	file := cfg.Token.File
+	if len(file) == 0 {
+		file = cfg.StatePath("token")
+	}
+	key := sha256.Sum256([]byte("utMsgDaemon:" + cfg.Service.Name + ":" + machineID))
+	return &fileTokenStore{file: file, key: key[:]}, nil
+}
+
+func (f *fileTokenStore) Load() (string, error) {
+	data, err := ioutil.ReadFile(f.file)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	gcm, err := f.cipher()
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("token file corrupted")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		// machine-id变化或文件被篡改
+		return "", errors.New("token file corrupted")
+	}
+	return string(plain), nil
+}
+
+func (f *fileTokenStore) Save(token string) error {
+	gcm, err := f.cipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	if err := MakeDir(filepath.Dir(f.file)); err != nil {
+		return err
+	}
+	return writeFileAtomic(f.file, gcm.Seal(nonce, nonce, []byte(token), nil), 0600)
+}
+
+func (f *fileTokenStore) Clear() error {
+	err := os.Remove(f.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (f *fileTokenStore) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(f.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//
+// TokenExpiry
+//  @Description: 解析JWT格式token中的exp，非JWT或未设置exp时返回零值
+//  @param token
+//  @return time.Time
+//
+func TokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+//----------------------辅助函数------------------------
+func readMachineID() (string, error) {
+	for _, item := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		data, err := ioutil.ReadFile(item)
+		if err == nil && len(strings.TrimSpace(string(data))) != 0 {
+			return strings.TrimSpace(string(data)), nil
+		}
+	}
+	return "", errors.New("machine id not found")
+}
+
+//writeFileAtomic 先写临时文件再重命名，避免写入中断时留下不完整的文件
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
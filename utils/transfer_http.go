@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//errTransferStalled 对象存储超过transfer.timeout没有响应，按网络不可用处理，任务稍后重试
+var errTransferStalled = &Error{Kind: KindNetworkUnavailable, Code: -1, Message: "object storage request timeout"}
+
+//transferHTTP 对象存储请求共用的http客户端，transfer.timeout变化后重新创建
+var transferHTTP struct {
+	mut     sync.Mutex
+	client  *http.Client
+	timeout time.Duration
+}
+
+//transferClient 获取共用的http客户端及当前的超时时间
+func transferClient() (*http.Client, time.Duration) {
+	timeout := Conf().Transfer.Timeout
+	transferHTTP.mut.Lock()
+	defer transferHTTP.mut.Unlock()
+	if transferHTTP.client == nil || transferHTTP.timeout != timeout {
+		dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+		// 传输大文件耗时不确定，不设置整体超时，由doTransfer按连续无数据的时间中断
+		transferHTTP.client = &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			ExpectContinueTimeout: time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   16,
+		}}
+		transferHTTP.timeout = timeout
+	}
+	return transferHTTP.client, timeout
+}
+
+//
+// doTransfer
+//  @Description: 通过共用的客户端发送对象存储请求，连接、等待响应以及请求体、响应体连续没有数据超过transfer.timeout时中断请求，
+//  对象存储无响应又不断开连接时任务不会一直阻塞；限速等待的时间不计入
+//  @param req
+//  @return *http.Response 响应体关闭后停止计时
+//  @return error 超时返回errTransferStalled
+//
+func doTransfer(req *http.Request) (*http.Response, error) {
+	client, timeout := transferClient()
+	ctx, cancel := context.WithCancel(req.Context())
+	w := &stallWatch{timeout: timeout, parent: req.Context()}
+	w.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&w.fired, 1)
+		cancel()
+	})
+	req = req.WithContext(ctx)
+	var body *stallReader
+	if req.Body != nil && req.Body != http.NoBody {
+		// 请求体由transport读取后写入连接，两次读取之间是写入等待的时间
+		body = &stallReader{ReadCloser: req.Body, watch: w}
+		req.Body = body
+	}
+	resp, err := client.Do(req)
+	if body != nil {
+		// 收到响应后transport可能仍在读取请求体，不再重新计时
+		atomic.StoreInt32(&body.done, 1)
+	}
+	if err != nil {
+		w.timer.Stop()
+		cancel()
+		return nil, w.wrap(err)
+	}
+	w.timer.Stop()
+	resp.Body = &stallReader{ReadCloser: resp.Body, watch: w, inside: true, cancel: cancel}
+	return resp, nil
+}
+
+//----------------------辅助函数------------------------
+
+//stallWatch 请求无数据计时，超时后取消请求
+type stallWatch struct {
+	timer   *time.Timer
+	timeout time.Duration
+	parent  context.Context //调用方的ctx
+	fired   int32
+}
+
+//wrap 超时导致的错误(包括transport的连接、等待响应超时)转换为errTransferStalled，调用方ctx到期不转换
+func (w *stallWatch) wrap(err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	var nerr net.Error
+	if atomic.LoadInt32(&w.fired) == 1 || (errors.As(err, &nerr) && nerr.Timeout() && w.parent.Err() == nil) {
+		return errTransferStalled
+	}
+	return err
+}
+
+//stallReader inside为true时只在Read期间计时(响应体)，否则只在两次Read之间计时(请求体，Read中包含限速等待)
+type stallReader struct {
+	io.ReadCloser
+	watch  *stallWatch
+	inside bool
+	cancel context.CancelFunc //响应体关闭时释放请求
+	done   int32              //请求已结束，不再计时
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	if r.inside {
+		r.watch.timer.Reset(r.watch.timeout)
+	} else if atomic.LoadInt32(&r.done) == 0 {
+		r.watch.timer.Stop()
+	}
+	n, err := r.ReadCloser.Read(p)
+	if r.inside {
+		r.watch.timer.Stop()
+	} else if atomic.LoadInt32(&r.done) == 0 {
+		r.watch.timer.Reset(r.watch.timeout)
+	}
+	return n, r.watch.wrap(err)
+}
+
+func (r *stallReader) Close() error {
+	err := r.ReadCloser.Close()
+	if r.cancel != nil {
+		r.watch.timer.Stop()
+		r.cancel()
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package utcloud
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// OSInfo 系统信息
+type OSInfo struct {
+	Name    string `json:"os_name"`
+	Edition string `json:"os_edition"`
+	Version string `json:"os_version"` //MajorVersion.MinorVersion
+}
+
+// AppInfo 应用信息，服务端通过callback_dbus_*回调应用
+type AppInfo struct {
+	CallbackMethod string `json:"callback_dbus_method"`
+	CallbackName   string `json:"callback_dbus_name"`
+	CallbackPath   string `json:"callback_dbus_path"`
+	Description    string `json:"description"`
+	Developer      string `json:"developer"`
+	Email          string `json:"email"`
+	Name           string `json:"name"`
+	Path           string `json:"path"`
+	ShowSwitcher   bool   `json:"show_switcher"`
+}
+
+const (
+	ACLGet = "get"
+	ACLPut = "put"
+	// ACLMultipart 分片上传授权，GET /api/v0/app/acl时除method外还需要size、part_size、part_count，
+	// 续传时带上upload_id；服务端需要发起(或沿用未过期的)分片上传并返回upload_id、part_count个分片PUT地址
+	// part_urls及POST合并分片的complete_url。不支持的服务端返回4xx或不返回这些字段，客户端改为put单次上传
+	ACLMultipart = "multipart"
+)
+
+// ACLRequest 申请对象存储临时授权的参数
+type ACLRequest struct {
+	BinPath   string
+	Key       string
+	Method    string //get、put或multipart
+	MD5       string //put及multipart时的文件md5
+	Size      int64  //以下为multipart参数
+	PartSize  int64
+	PartCount int
+	UploadID  string //不为空时为已有的分片上传重新签发地址
+}
+
+// ACL 对象存储临时授权
+type ACL struct {
+	SignURL     string   `json:"sign_url"`     //get、put的签名地址
+	MD5         string   `json:"md5"`          //get时对象的md5，可能为空
+	UploadID    string   `json:"upload_id"`    //以下为multipart授权
+	PartURLs    []string `json:"part_urls"`    //part_urls[i]对应第i+1个分片的PUT地址
+	CompleteURL string   `json:"complete_url"` //POST合并分片的地址
+}
+
+type idData struct {
+	ID string `json:"id"`
+}
+
+type fileParams struct {
+	BinPath string `json:"bin_path"`
+	Key     string `json:"key"`
+}
+
+// AddOS 添加系统，返回系统ID
+func (c *Client) AddOS(ctx context.Context, info OSInfo) (string, error) {
+	var data idData
+	err := c.do(ctx, http.MethodPut, "/api/v0/access/os", nil, info, false, &data)
+	return data.ID, err
+}
+
+// AddApp 添加应用，返回应用ID
+func (c *Client) AddApp(ctx context.Context, app AppInfo) (string, error) {
+	var data idData
+	err := c.do(ctx, http.MethodPut, "/api/v0/access/app", nil, app, false, &data)
+	return data.ID, err
+}
+
+// AttachApps 绑定应用到系统
+func (c *Client) AttachApps(ctx context.Context, osID string, appIDs []string) error {
+	body := map[string]interface{}{
+		"appids": appIDs,
+		"osid":   osID,
+	}
+	return c.do(ctx, http.MethodPut, "/api/v0/access/attach", nil, body, true, nil)
+}
+
+// GetACL 申请对象存储临时授权
+func (c *Client) GetACL(ctx context.Context, r ACLRequest) (*ACL, error) {
+	query := url.Values{}
+	query.Set("bin_path", r.BinPath)
+	query.Set("key", r.Key)
+	query.Set("method", r.Method)
+	if len(r.MD5) != 0 {
+		query.Set("md5", r.MD5)
+	}
+	if r.Method == ACLMultipart {
+		query.Set("size", strconv.FormatInt(r.Size, 10))
+		query.Set("part_size", strconv.FormatInt(r.PartSize, 10))
+		query.Set("part_count", strconv.Itoa(r.PartCount))
+		if len(r.UploadID) != 0 {
+			query.Set("upload_id", r.UploadID)
+		}
+	}
+	var data struct {
+		Acl ACL `json:"acl"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v0/app/acl", query, nil, true, &data); err != nil {
+		return nil, err
+	}
+	return &data.Acl, nil
+}
+
+// PutMeta 上传完成后通知服务端记录文件，返回记录ID
+func (c *Client) PutMeta(ctx context.Context, binPath, key string) (string, error) {
+	var data idData
+	err := c.do(ctx, http.MethodPut, "/api/v0/app/meta", nil, fileParams{BinPath: binPath, Key: key}, true, &data)
+	return data.ID, err
+}
+
+// DeleteMeta 删除服务端记录的文件
+func (c *Client) DeleteMeta(ctx context.Context, binPath, key string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v0/app/meta", nil, fileParams{BinPath: binPath, Key: key}, true, nil)
+}
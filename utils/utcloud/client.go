@@ -0,0 +1,212 @@
+// Package utcloud utcloud服务端接口客户端
+package utcloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTimeout = 30 * time.Second
+	defaultRetries = 2
+	defaultBackoff = 500 * time.Millisecond
+	maxBackoff     = 10 * time.Second
+	tokenName      = "token"
+)
+
+var (
+	jitterLock sync.Mutex
+	jitter     = rand.New(rand.NewSource(time.Now().UnixNano())) //全局math/rand未设置种子，各进程的抖动序列相同
+)
+
+// Client utcloud服务端接口客户端，字段在创建后不要修改
+type Client struct {
+	BaseURL    string        //服务端地址，如http://utcloud-pre.chinauos.com
+	Token      string        //云服务token，通过token请求头及cookie发送
+	HTTPClient *http.Client  //为nil时使用http.DefaultClient
+	Timeout    time.Duration //单次请求的超时时间，0表示只受ctx控制
+	Retries    int           //失败后的最大重试次数
+	Backoff    time.Duration //首次重试前的等待时间，之后每次翻倍并加入随机抖动
+}
+
+//
+// NewClient
+//  @Description: 创建客户端，使用默认的超时及重试参数
+//  @param baseURL 服务端地址
+//  @param token 云服务token
+//  @return *Client
+//
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Token:   token,
+		Timeout: defaultTimeout,
+		Retries: defaultRetries,
+		Backoff: defaultBackoff,
+	}
+}
+
+// Error 服务端返回的错误，HTTP状态码非200或响应中result为false
+type Error struct {
+	StatusCode int    //HTTP状态码
+	Code       int    //响应中的code
+	Msg        string //响应中的msg
+}
+
+func (e *Error) Error() string {
+	if len(e.Msg) != 0 {
+		return e.Msg
+	}
+	return fmt.Sprintf("utcloud: response status %d", e.StatusCode)
+}
+
+//response 服务端接口的通用响应
+type response struct {
+	Code   int             `json:"code"`
+	Data   json.RawMessage `json:"data"`
+	Msg    string          `json:"msg"`
+	Result bool            `json:"result"`
+}
+
+//
+// do
+//  @Description: 请求服务端接口并解析响应中的data，失败时按idempotent决定是否重试
+//  @param ctx
+//  @param method
+//  @param api 接口路径，如/api/v0/app/acl
+//  @param query 查询参数，可为nil
+//  @param body 请求体，以json发送，可为nil
+//  @param idempotent 接口是否幂等，非幂等接口只在请求确定没有到达服务端时重试
+//  @param data 解析data的目标，可为nil
+//  @return error
+//
+func (c *Client) do(ctx context.Context, method, api string, query url.Values, body interface{}, idempotent bool, data interface{}) error {
+	var bd []byte
+	if body != nil {
+		var err error
+		if bd, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	log.Debugf("utcloud request method is:[%s], api is:[%s], query is:[%s] body is:[%s]", method, api, query.Encode(), bd)
+	var err error
+	for i := 0; ; i++ {
+		var retry bool
+		retry, err = c.once(ctx, method, api, query, bd, idempotent, data)
+		if err == nil || !retry || i >= c.Retries {
+			return err
+		}
+		delay := c.backoff(i)
+		log.Warnf("utcloud %s %s error:[%s], retry after %s", method, api, err.Error(), delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+//once 发送一次请求，返回错误是否可以重试
+func (c *Client) once(ctx context.Context, method, api string, query url.Values, body []byte, idempotent bool, data interface{}) (bool, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+api, reader)
+	if err != nil {
+		return false, err
+	}
+	if len(query) != 0 {
+		req.URL.RawQuery = query.Encode()
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(c.Token) != 0 {
+		req.AddCookie(&http.Cookie{Name: tokenName, Value: c.Token, HttpOnly: true})
+		req.Header.Set(tokenName, c.Token)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil && errors.Is(ctx.Err(), context.Canceled) {
+			// 调用方取消，不重试
+			return false, ctx.Err()
+		}
+		return idempotent || notSent(err), err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		e := &Error{StatusCode: resp.StatusCode, Msg: strings.TrimSpace(string(msg))}
+		var r response
+		if json.Unmarshal(msg, &r) == nil && len(r.Msg) != 0 {
+			e.Code, e.Msg = r.Code, r.Msg
+		}
+		return retryStatus(resp.StatusCode, idempotent), e
+	}
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return false, fmt.Errorf("utcloud: invalid response: %v", err)
+	}
+	log.Debugf("utcloud response %s %s: result:[%v] code:[%d] msg:[%s] data:[%s]", method, api, r.Result, r.Code, r.Msg, r.Data)
+	if !r.Result {
+		return false, &Error{StatusCode: resp.StatusCode, Code: r.Code, Msg: r.Msg}
+	}
+	if data != nil && len(r.Data) != 0 {
+		if err := json.Unmarshal(r.Data, data); err != nil {
+			return false, fmt.Errorf("utcloud: invalid response data: %v", err)
+		}
+	}
+	return false, nil
+}
+
+//backoff 第i次重试前的等待时间，指数增长并在[d/2, d)内随机，避免多个客户端同时重试
+func (c *Client) backoff(i int) time.Duration {
+	d := c.Backoff << uint(i)
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+	return d/2 + time.Duration(jitter.Int63n(int64(d/2)+1))
+}
+
+//notSent 请求是否确定没有发送到服务端(如连接失败)，此时非幂等接口也可以重试
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+//retryStatus 状态码是否可以重试，429和503表示服务端没有处理请求
+func retryStatus(status int, idempotent bool) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
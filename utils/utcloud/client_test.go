@@ -0,0 +1,279 @@
+package utcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//testServer 按请求次数(从1开始)返回响应的服务端，返回请求次数计数
+func testServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, n int32)) (*httptest.Server, *int32) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r, atomic.AddInt32(&hits, 1))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func testClient(baseURL string) *Client {
+	c := NewClient(baseURL, "tk")
+	c.Backoff = time.Millisecond
+	return c
+}
+
+func reply(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprint(w, body)
+}
+
+const okACL = `{"code":0,"result":true,"msg":"","data":{"acl":{"sign_url":"http://oss/a","md5":"m"}}}`
+const okID = `{"code":0,"result":true,"msg":"","data":{"id":"id-1"}}`
+
+func TestClientRetryStatus(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		fails  int32 //前fails次请求返回status
+		call   func(c *Client) error
+		hits   int32
+		ok     bool
+	}{
+		{name: "get 503 retried", status: http.StatusServiceUnavailable, fails: 1, call: getACL, hits: 2, ok: true},
+		{name: "get 429 retried", status: http.StatusTooManyRequests, fails: 2, call: getACL, hits: 3, ok: true},
+		{name: "get 500 retried", status: http.StatusInternalServerError, fails: 1, call: getACL, hits: 2, ok: true},
+		{name: "get retries exhausted", status: http.StatusServiceUnavailable, fails: 10, call: getACL, hits: 3},
+		{name: "get 404 not retried", status: http.StatusNotFound, fails: 1, call: getACL, hits: 1},
+		{name: "add os 503 retried", status: http.StatusServiceUnavailable, fails: 1, call: addOS, hits: 2, ok: true},
+		{name: "add app 429 retried", status: http.StatusTooManyRequests, fails: 1, call: addApp, hits: 2, ok: true},
+		{name: "add os 500 not retried", status: http.StatusInternalServerError, fails: 1, call: addOS, hits: 1},
+		{name: "add app 502 not retried", status: http.StatusBadGateway, fails: 1, call: addApp, hits: 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, hits := testServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+				if r.Header.Get(tokenName) != "tk" {
+					t.Errorf("expect token header, got %q", r.Header.Get(tokenName))
+				}
+				if n <= tc.fails {
+					reply(w, tc.status, `{"code":1,"result":false,"msg":"busy"}`)
+					return
+				}
+				if r.Method == http.MethodGet {
+					reply(w, http.StatusOK, okACL)
+				} else {
+					reply(w, http.StatusOK, okID)
+				}
+			})
+			err := tc.call(testClient(srv.URL))
+			if got := atomic.LoadInt32(hits); got != tc.hits {
+				t.Fatalf("expect %d requests, got %d", tc.hits, got)
+			}
+			if tc.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var e *Error
+			if !errors.As(err, &e) || e.StatusCode != tc.status || e.Code != 1 || e.Msg != "busy" {
+				t.Fatalf("expect *Error with status %d, got %#v", tc.status, err)
+			}
+		})
+	}
+}
+
+func TestClientNotRetryAfterSent(t *testing.T) {
+	// 读取请求后断开连接，请求已到达服务端
+	srv, hits := testServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	})
+	for _, tc := range []struct {
+		name string
+		call func(c *Client) error
+		hits int32
+	}{
+		{name: "add os", call: addOS, hits: 1},
+		{name: "add app", call: addApp, hits: 1},
+		{name: "get acl", call: getACL, hits: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(hits, 0)
+			if err := tc.call(testClient(srv.URL)); err == nil {
+				t.Fatal("expect error")
+			}
+			if got := atomic.LoadInt32(hits); got != tc.hits {
+				t.Fatalf("expect %d requests, got %d", tc.hits, got)
+			}
+		})
+	}
+}
+
+func TestClientRetryNotSent(t *testing.T) {
+	// 连接失败时请求没有发送，非幂等接口也重试
+	var dials int32
+	c := testClient("http://utcloud.invalid")
+	c.HTTPClient = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+		},
+	}}
+	if _, err := c.AddOS(context.Background(), OSInfo{Name: "uos"}); err == nil {
+		t.Fatal("expect error")
+	}
+	if got := atomic.LoadInt32(&dials); got != int32(c.Retries+1) {
+		t.Fatalf("expect %d dials, got %d", c.Retries+1, got)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv, hits := testServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		if n == 1 {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		if r.Method == http.MethodGet {
+			reply(w, http.StatusOK, okACL)
+		} else {
+			reply(w, http.StatusOK, okID)
+		}
+	})
+	defer close(release)
+
+	// 单次请求超时后幂等接口重试
+	c := testClient(srv.URL)
+	c.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	acl, err := c.GetACL(context.Background(), ACLRequest{BinPath: "/usr/bin/app", Key: "k", Method: ACLGet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl.SignURL != "http://oss/a" || acl.MD5 != "m" {
+		t.Fatalf("unexpected acl %+v", acl)
+	}
+	if got := atomic.LoadInt32(hits); got != 2 {
+		t.Fatalf("expect 2 requests, got %d", got)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("timeout not applied, took %s", elapsed)
+	}
+
+	// 非幂等接口超时后不重试
+	atomic.StoreInt32(hits, 0)
+	_, err = c.AddOS(context.Background(), OSInfo{Name: "uos"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+	if got := atomic.LoadInt32(hits); got != 1 {
+		t.Fatalf("expect 1 request, got %d", got)
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	release := make(chan struct{})
+	srv, hits := testServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer close(release)
+
+	c := testClient(srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := c.GetACL(ctx, ACLRequest{Key: "k", Method: ACLGet})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect canceled, got %v", err)
+	}
+	if got := atomic.LoadInt32(hits); got != 1 {
+		t.Fatalf("expect 1 request, got %d", got)
+	}
+}
+
+func TestClientCancelDuringBackoff(t *testing.T) {
+	srv, hits := testServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		reply(w, http.StatusServiceUnavailable, "")
+	})
+	c := testClient(srv.URL)
+	c.Backoff = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := c.GetACL(ctx, ACLRequest{Key: "k", Method: ACLGet})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("cancel did not stop backoff, took %s", elapsed)
+	}
+	if got := atomic.LoadInt32(hits); got != 1 {
+		t.Fatalf("expect 1 request, got %d", got)
+	}
+}
+
+func TestClientResultFalse(t *testing.T) {
+	srv, hits := testServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		reply(w, http.StatusOK, `{"code":404,"result":false,"msg":"record not exist","data":null}`)
+	})
+	err := testClient(srv.URL).DeleteMeta(context.Background(), "/usr/bin/app", "k")
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("expect *Error, got %#v", err)
+	}
+	if e.StatusCode != http.StatusOK || e.Code != 404 || e.Msg != "record not exist" || e.Error() != "record not exist" {
+		t.Fatalf("unexpected error %#v", e)
+	}
+	if got := atomic.LoadInt32(hits); got != 1 {
+		t.Fatalf("expect 1 request, got %d", got)
+	}
+}
+
+func TestClientBackoff(t *testing.T) {
+	c := &Client{Backoff: 100 * time.Millisecond}
+	for i := 0; i < 10; i++ {
+		d := c.Backoff << uint(i)
+		if d > maxBackoff {
+			d = maxBackoff
+		}
+		for j := 0; j < 20; j++ {
+			if got := c.backoff(i); got < d/2 || got > d {
+				t.Fatalf("backoff(%d) = %s, expect in [%s, %s]", i, got, d/2, d)
+			}
+		}
+	}
+}
+
+//----------------------辅助函数------------------------
+
+func getACL(c *Client) error {
+	_, err := c.GetACL(context.Background(), ACLRequest{BinPath: "/usr/bin/app", Key: "k", Method: ACLGet})
+	return err
+}
+
+func addOS(c *Client) error {
+	_, err := c.AddOS(context.Background(), OSInfo{Name: "uos"})
+	return err
+}
+
+func addApp(c *Client) error {
+	_, err := c.AddApp(context.Background(), AppInfo{Name: "app"})
+	return err
+}
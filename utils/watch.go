@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+//maxDebounceFactor 持续有变化时最多推迟debounce的倍数，避免一直写入的目录永远不同步
+const maxDebounceFactor = 10
+
+// DirWatcher 监听目录树的变化，一段时间内没有新的变化后回调；
+// 超过inotify数量限制等无法监听的情况下改为按sync.scan_interval定期回调
+type DirWatcher struct {
+	dir      string
+	onChange func()
+	watcher  *fsnotify.Watcher //为nil时定期扫描
+	stop     chan struct{}
+	once     sync.Once
+}
+
+//
+// NewDirWatcher
+//  @Description: 创建目录监听，调用Start后开始监听
+//  @param dir 监听的目录，包括所有子目录
+//  @param onChange 目录有变化时回调，在监听协程中调用，不要阻塞
+//  @return *DirWatcher
+//
+func NewDirWatcher(dir string, onChange func()) *DirWatcher {
+	return &DirWatcher{dir: dir, onChange: onChange, stop: make(chan struct{})}
+}
+
+// Start 开始监听
+func (w *DirWatcher) Start() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warnf("watch %s error:[%s], fallback to periodic scan", w.dir, err.Error())
+	} else {
+		w.watcher = watcher
+		if err := w.addTree(w.dir); err != nil {
+			w.fallback(err)
+		}
+	}
+	go w.run()
+}
+
+// Close 停止监听
+func (w *DirWatcher) Close() {
+	w.once.Do(func() {
+		close(w.stop)
+	})
+}
+
+//----------------------辅助函数------------------------
+
+func (w *DirWatcher) run() {
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+	defer debounce.Stop()
+	var pendingSince time.Time
+	var scan <-chan time.Time
+	var ticker *time.Ticker
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+		if w.watcher != nil {
+			_ = w.watcher.Close()
+		}
+	}()
+
+	for {
+		var events <-chan fsnotify.Event
+		var errs <-chan error
+		if w.watcher != nil {
+			events, errs = w.watcher.Events, w.watcher.Errors
+		} else if ticker == nil {
+			ticker = time.NewTicker(Conf().Sync.ScanInterval)
+			scan = ticker.C
+		}
+		select {
+		case <-w.stop:
+			return
+		case ev := <-events:
+			if SyncIgnored(ev.Name) || filepath.Ext(ev.Name) == partFileSuffix {
+				continue
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
+					if err := w.addTree(ev.Name); err != nil {
+						w.fallback(err)
+					}
+				}
+			}
+			// 合并短时间内的多次变化，但不超过debounce的maxDebounceFactor倍
+			delay := Conf().Sync.Debounce
+			if pendingSince.IsZero() {
+				pendingSince = time.Now()
+			} else if time.Since(pendingSince) > delay*maxDebounceFactor {
+				continue
+			}
+			if !debounce.Stop() {
+				select {
+				case <-debounce.C:
+				default:
+				}
+			}
+			debounce.Reset(delay)
+		case err := <-errs:
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// 事件丢失后无法确定哪些文件变化，直接同步一次
+				log.Warnf("watch %s overflow, sync now", w.dir)
+				w.onChange()
+				continue
+			}
+			log.Errorf("watch %s error:[%s]", w.dir, err.Error())
+		case <-debounce.C:
+			pendingSince = time.Time{}
+			w.onChange()
+		case <-scan:
+			w.onChange()
+		}
+	}
+}
+
+//addTree 监听目录及其所有子目录，fsnotify只监听单层目录
+func (w *DirWatcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(item string, info os.FileInfo, err error) error {
+		if err != nil {
+			if item == dir {
+				return err
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if item != w.dir && SyncIgnored(item) {
+			return filepath.SkipDir
+		}
+		return w.watcher.Add(item)
+	})
+}
+
+//fallback 无法继续监听时改为定期扫描，超过inotify数量限制时会返回ENOSPC
+func (w *DirWatcher) fallback(err error) {
+	if errors.Is(err, syscall.ENOSPC) {
+		log.Warnf("watch %s exceed inotify limit, fallback to periodic scan", w.dir)
+	} else {
+		log.Warnf("watch %s error:[%s], fallback to periodic scan", w.dir, err.Error())
+	}
+	_ = w.watcher.Close()
+	w.watcher = nil
+}